@@ -0,0 +1,404 @@
+// Package admin is the gopush2 publisher client of the admin http api, it
+// publishes messages, creates channels and gets stats, optionally routes
+// every key to the gopush2 node owning it by the same ketama consistent
+// hashing ring of the live nodes as the gopush2 /node api.
+// SignToken signs the subscription tokens for the signed token auth mode.
+//
+//	c, err := admin.New(&admin.Options{Addrs: []string{"127.0.0.1:8081"}})
+//	if err != nil {
+//		return err
+//	}
+//
+//	mid, err := c.Publish("Terry-Mao", "hello", 0, admin.AutoMsgID)
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gopush2/hash"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ret codes of the admin http api
+const (
+	RetOK            = 0
+	RetCreateChannel = 1
+	RetAddChannel    = 2
+	RetGetChannel    = 3
+	RetAddToken      = 4
+	RetPushMsg       = 5
+	RetReloadConfig  = 6
+	RetAckStat       = 7
+	RetGetNode       = 8
+	RetParamErr      = 65534
+	RetInternalErr   = 65535
+)
+
+const (
+	// Message id allocated by the channel
+	AutoMsgID          = int64(0)
+	defaultTimeout     = 5 * time.Second
+	defaultMaxIdleConn = 16
+	defaultRefresh     = 10 * time.Second
+	// same as the gopush2 node ring
+	nodeVNode = 255
+)
+
+var (
+	// No gopush2 node address
+	NoAddrErr = errors.New("admin: no gopush2 address")
+	// Internal failed
+	InternalErr = errors.New("admin: gopush2 internal error")
+	// Param error
+	ParamErr = errors.New("admin: param error")
+	// Create channel failed
+	CreateChannelErr = errors.New("admin: create channel failed")
+	// Add channel failed
+	AddChannelErr = errors.New("admin: add channel failed")
+	// Get channel failed
+	GetChannelErr = errors.New("admin: get channel failed")
+	// Add token failed
+	AddTokenErr = errors.New("admin: add token failed")
+	// Message push failed
+	PushMsgErr = errors.New("admin: push message failed")
+	// Reload config failed
+	ReloadConfigErr = errors.New("admin: reload config failed")
+	// Get ack stat failed
+	AckStatErr = errors.New("admin: get ack stat failed")
+	// Get node failed
+	GetNodeErr = errors.New("admin: get node failed")
+
+	retErrs = map[int]error{
+		RetInternalErr:   InternalErr,
+		RetParamErr:      ParamErr,
+		RetCreateChannel: CreateChannelErr,
+		RetAddChannel:    AddChannelErr,
+		RetGetChannel:    GetChannelErr,
+		RetAddToken:      AddTokenErr,
+		RetPushMsg:       PushMsgErr,
+		RetReloadConfig:  ReloadConfigErr,
+		RetAckStat:       AckStatErr,
+		RetGetNode:       GetNodeErr,
+	}
+)
+
+// RetErr is the unknown ret code error.
+type RetErr struct {
+	Ret int
+	Msg string
+}
+
+func (e *RetErr) Error() string {
+	return fmt.Sprintf("admin: ret %d (%s)", e.Ret, e.Msg)
+}
+
+// StatusErr is the non 200 http status error.
+type StatusErr struct {
+	Status int
+	Body   string
+}
+
+func (e *StatusErr) Error() string {
+	return fmt.Sprintf("admin: http status %d (%s)", e.Status, e.Body)
+}
+
+// NodeInfo is the gopush2 node info.
+type NodeInfo struct {
+	// Node name
+	Node string `json:"node"`
+	// Subscriber addresses, empty if the protocol disabled
+	TCPAddr       string `json:"tcp_addr"`
+	WebsocketAddr string `json:"websocket_addr"`
+	// Admin address
+	AdminAddr string `json:"admin_addr"`
+	// Subscriber conn number
+	Conn int `json:"conn"`
+}
+
+// Options is the admin client options.
+type Options struct {
+	// Admin addresses of the gopush2 nodes, the live nodes loaded from them
+	Addrs []string
+	// Route the key to the node by ketama, else always use the first address
+	Ketama bool
+	// Reload the live nodes interval
+	Refresh time.Duration
+	// Request timeout, include dialing
+	Timeout time.Duration
+	// Max idle conns per node
+	MaxIdleConn int
+}
+
+// Client is the admin http api client, safe for concurrent use.
+type Client struct {
+	addrs   []string
+	http    *http.Client
+	route   bool
+	refresh time.Duration
+	// Mutex
+	mutex *sync.Mutex
+	// Ring of the live node names, nil if not loaded
+	ring *hash.Ketama
+	// Admin address by the node name
+	admins map[string]string
+	// Last loaded time
+	loaded time.Time
+	// A goroutine loading the live nodes
+	loading bool
+}
+
+// New create a admin client, the live nodes loaded once if route by ketama,
+// then reloaded in background every Options.Refresh.
+func New(opts *Options) (*Client, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, NoAddrErr
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	maxIdleConn := opts.MaxIdleConn
+	if maxIdleConn <= 0 {
+		maxIdleConn = defaultMaxIdleConn
+	}
+
+	refresh := opts.Refresh
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+
+	c := &Client{
+		addrs:   opts.Addrs,
+		route:   opts.Ketama,
+		refresh: refresh,
+		mutex:   &sync.Mutex{},
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.DialTimeout(network, addr, timeout)
+				},
+				MaxIdleConnsPerHost:   maxIdleConn,
+				ResponseHeaderTimeout: timeout,
+			},
+			Timeout: timeout,
+		},
+	}
+
+	if c.route {
+		// the later loads in background
+		c.loading = true
+		c.load()
+	}
+
+	return c, nil
+}
+
+// Addr return the admin address of the node owning the key, the first
+// address if the live nodes can't be loaded.
+func (c *Client) Addr(key string) string {
+	if !c.route {
+		return c.addrs[0]
+	}
+
+	c.mutex.Lock()
+	ring, admins := c.ring, c.admins
+	if !c.loading && time.Since(c.loaded) > c.refresh {
+		// only one loading, the old ring used meanwhile
+		c.loading = true
+		go c.load()
+	}
+
+	c.mutex.Unlock()
+	if ring == nil {
+		return c.addrs[0]
+	}
+
+	if addr, ok := admins[ring.Node(key)]; ok && addr != "" {
+		return addr
+	}
+
+	return c.addrs[0]
+}
+
+// load get the live nodes from any address out of the lock, then swap the
+// ring by the node names in, keep the old ring if failed. The caller must
+// set the loading flag.
+func (c *Client) load() {
+	ring, admins := c.fetch()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ring != nil {
+		c.ring = ring
+		c.admins = admins
+	}
+
+	c.loaded = time.Now()
+	c.loading = false
+}
+
+// fetch get the live nodes from any address and build the ring, nil if all
+// failed.
+func (c *Client) fetch() (*hash.Ketama, map[string]string) {
+	for _, addr := range c.addrs {
+		infos := []*NodeInfo{}
+		if err := c.do("GET", addr, "/node", url.Values{}, "", &infos); err != nil || len(infos) == 0 {
+			continue
+		}
+
+		weights := map[string]int{}
+		admins := map[string]string{}
+		for _, n := range infos {
+			weights[n.Node] = 1
+			admins[n.Node] = n.AdminAddr
+		}
+
+		return hash.NewKetamaNodes(weights, nodeVNode), admins
+	}
+
+	return nil, nil
+}
+
+// Publish publish a message to the key, expire 0 use the gopush2 default
+// setting, mid AutoMsgID allocated by the channel. Return the message id.
+func (c *Client) Publish(key, msg string, expire time.Duration, mid int64) (int64, error) {
+	params := url.Values{}
+	params.Set("key", key)
+	if expire > 0 {
+		params.Set("expire", strconv.FormatInt(int64(expire/time.Second), 10))
+	}
+
+	if mid != AutoMsgID {
+		params.Set("mid", strconv.FormatInt(mid, 10))
+	}
+
+	data := &struct {
+		Mid int64 `json:"mid"`
+	}{}
+	if err := c.do("POST", c.Addr(key), "/pub", params, msg, data); err != nil {
+		return 0, err
+	}
+
+	return data.Mid, nil
+}
+
+// CreateChannel create the channel of the key with a token, the gopush2 auth
+// must be enabled.
+func (c *Client) CreateChannel(key, token string) error {
+	return c.AddToken(key, token)
+}
+
+// AddToken add a token to the channel of the key, the channel created if not
+// exists.
+func (c *Client) AddToken(key, token string) error {
+	params := url.Values{}
+	params.Set("key", key)
+	params.Set("token", token)
+	return c.do("GET", c.Addr(key), "/ch", params, "", nil)
+}
+
+// Node ask the gopush2 cluster which node the key belongs to, the
+// subscriber of the key should connect to it.
+func (c *Client) Node(key string) (*NodeInfo, error) {
+	params := url.Values{}
+	params.Set("key", key)
+	n := &NodeInfo{}
+	if err := c.do("GET", c.Addr(key), "/node", params, "", n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Stats get the stats of all the nodes, typ is one of memory, server,
+// golang, confit, channel, conn. Return the stats of every address.
+func (c *Client) Stats(typ string) (map[string]map[string]interface{}, error) {
+	params := url.Values{}
+	params.Set("type", typ)
+	res := map[string]map[string]interface{}{}
+	for _, addr := range c.addrs {
+		resp, err := c.http.Get("http://" + addr + "/stat?" + params.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := readBody(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		stat := map[string]interface{}{}
+		if err = json.Unmarshal(body, &stat); err != nil {
+			return nil, err
+		}
+
+		res[addr] = stat
+	}
+
+	return res, nil
+}
+
+// do request the admin api, decode the ret payload, data decoded if not nil.
+func (c *Client) do(method, addr, path string, params url.Values, body string, data interface{}) error {
+	req, err := http.NewRequest(method, "http://"+addr+path+"?"+params.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	b, err := readBody(resp)
+	if err != nil {
+		return err
+	}
+
+	ret := &struct {
+		Ret  int             `json:"ret"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err = json.Unmarshal(b, ret); err != nil {
+		return err
+	}
+
+	if ret.Ret != RetOK {
+		if err, ok := retErrs[ret.Ret]; ok {
+			return err
+		}
+
+		return &RetErr{Ret: ret.Ret, Msg: ret.Msg}
+	}
+
+	if data != nil && len(ret.Data) > 0 {
+		return json.Unmarshal(ret.Data, data)
+	}
+
+	return nil
+}
+
+// readBody read and close the response body, StatusErr if not 200.
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusErr{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"github.com/Terry-Mao/gopush2/hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Query().Get("key") {
+		case "Terry-Mao":
+			if string(body) != "test" || r.URL.Query().Get("expire") != "60" {
+				w.Write([]byte(`{"ret":65534,"msg":"param error"}`))
+				return
+			}
+
+			w.Write([]byte(`{"ret":0,"msg":"ok","data":{"mid":1}}`))
+		case "unknown":
+			w.Write([]byte(`{"ret":100,"msg":"unknown"}`))
+		default:
+			w.Write([]byte(`{"ret":3,"msg":"can't get a subscriber"}`))
+		}
+	}))
+	defer s.Close()
+
+	c, err := New(&Options{Addrs: []string{strings.TrimPrefix(s.URL, "http://")}, Ketama: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mid, err := c.Publish("Terry-Mao", "test", 60e9, AutoMsgID); err != nil || mid != 1 {
+		t.Errorf("mid must be 1, but %d (%v)", mid, err)
+	}
+
+	if _, err = c.Publish("Terry", "test", 0, AutoMsgID); err != GetChannelErr {
+		t.Errorf("err must be GetChannelErr, but %v", err)
+	}
+
+	if _, err = c.Publish("unknown", "test", 0, AutoMsgID); err == nil {
+		t.Error("err must be RetErr")
+	} else if e, ok := err.(*RetErr); !ok || e.Ret != 100 {
+		t.Errorf("err must be RetErr, but %v", err)
+	}
+}
+
+func TestAddr(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ret":0,"msg":"ok","data":[{"node":"node-a","admin_addr":"10.0.0.1:8081"},{"node":"node-b","admin_addr":"10.0.0.2:8081"}]}`))
+	}))
+	defer s.Close()
+
+	c, err := New(&Options{Addrs: []string{strings.TrimPrefix(s.URL, "http://")}, Ketama: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same ring as the gopush2 /node api
+	ring := hash.NewKetamaNodes(map[string]int{"node-a": 1, "node-b": 1}, 255)
+	admins := map[string]string{"node-a": "10.0.0.1:8081", "node-b": "10.0.0.2:8081"}
+	for _, key := range []string{"Terry-Mao", "Terry", "test", "gopush2"} {
+		if addr := c.Addr(key); addr != admins[ring.Node(key)] {
+			t.Errorf("key %s addr must be %s, but %s", key, admins[ring.Node(key)], addr)
+		}
+	}
+}
+
+func TestAddrLoading(t *testing.T) {
+	block := make(chan bool)
+	loaded := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the node api hung after the first load
+		if loaded {
+			<-block
+		}
+
+		loaded = true
+		w.Write([]byte(`{"ret":0,"msg":"ok","data":[{"node":"node-a","admin_addr":"10.0.0.1:8081"}]}`))
+	}))
+	defer s.Close()
+	defer close(block)
+
+	c, err := New(&Options{Addrs: []string{strings.TrimPrefix(s.URL, "http://")}, Ketama: true, Refresh: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old ring used while loading
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if addr := c.Addr("Terry-Mao"); addr != "10.0.0.1:8081" {
+			t.Errorf("addr must be 10.0.0.1:8081, but %s", addr)
+		}
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("addr must not wait the loading, but %s", d)
+	}
+}
@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// The permissions of the signed token
+const (
+	PermSub = "sub"
+	PermPub = "pub"
+)
+
+// tokenPayload is the signed token payload, must match the gopush2 one
+type tokenPayload struct {
+	Key    string   `json:"key"`
+	Expire int64    `json:"exp"`
+	Perm   []string `json:"perm,omitempty"`
+}
+
+// SignToken sign a subscription token of the key for the gopush2 "auth": 2
+// mode, kid and secret must be one of the gopush2 "auth_keys", the token
+// expires after expire. If perms empty, the token only allow subscribing.
+//
+//	token, err := admin.SignToken("k1", secret, "Terry-Mao", time.Hour)
+func SignToken(kid, secret, key string, expire time.Duration, perms ...string) (string, error) {
+	payload, err := json.Marshal(&tokenPayload{Key: key, Expire: time.Now().Add(expire).Unix(), Perm: perms})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(kid)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
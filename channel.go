@@ -9,9 +9,7 @@ import (
 )
 
 const (
-	Second           = int64(time.Second)
-	InnerChannelType = 1
-	RedisChannelType = 2
+	Second = int64(time.Second)
 )
 
 var (
@@ -26,12 +24,15 @@ var (
 // The subscriber interface
 type Channel interface {
 	// PushMsg push a message to the subscriber.
+	// If the message id is AutoMsgID, allocate a increasing id for the key.
 	PushMsg(m *Message, key string) error
-	// SendMsg send messages which id greate than the request id to the subscriber.
-	// net.Conn write failed will return errors.
+	// SendMsg add a connection for the subscriber, send messages which id
+	// greate than the request id, then the live messages to it.
+	// Exceed the max number of subscribers per key or net.Conn write failed
+	// will return errors.
 	SendMsg(conn net.Conn, mid int64, key string) error
-	// AddConn add a connection for the subscriber.
-	// Exceed the max number of subscribers per key will return errors.
+	// AddConn finish adding the connection after SendMsg.
+	// The connection removed if returns errors.
 	AddConn(conn net.Conn, mid int64, key string) error
 	// RemoveConn remove a connection for the  subscriber.
 	RemoveConn(conn net.Conn, mid int64, key string) error
@@ -45,10 +46,27 @@ type Channel interface {
 	SetDeadline(d int64)
 	// Timeout
 	Timeout() bool
+	// Purge remove the expired messages, return the removed number.
+	Purge(key string) int
+	// Ack advance the acked message id of the subscriber, SendMsg resume
+	// from the acked message id if the request id is less.
+	Ack(mid int64, key string) error
+	// AckStat get the acked message id, delivered and unacked message number.
+	AckStat(key string) (*AckStat, error)
 	// Expire expire the channle and clean data.
 	Close() error
 }
 
+// The subscriber ack stat
+type AckStat struct {
+	// Last acked message id
+	Acked int64 `json:"acked"`
+	// Delivered message number of the node
+	Delivered int64 `json:"delivered"`
+	// Stored message number which id greate than the acked id
+	Unacked int `json:"unacked"`
+}
+
 type channelBucket struct {
 	data  map[string]Channel
 	mutex *sync.Mutex
@@ -66,7 +84,7 @@ func NewChannelList() *ChannelList {
 	l := &ChannelList{}
 	l.channels = []*channelBucket{}
 	// split hashmap to many bucket
-	for i := 0; i < Conf.ChannelBucket; i++ {
+	for i := 0; i < Conf().ChannelBucket; i++ {
 		c := &channelBucket{
 			data:  map[string]Channel{},
 			mutex: &sync.Mutex{},
@@ -75,9 +93,15 @@ func NewChannelList() *ChannelList {
 		l.channels = append(l.channels, c)
 	}
 
-	if Conf.ChannelType == 2 {
-		if err := InitRedisChannel(); err != nil {
-			LogError(LogLevelErr, "init redis channle failed (%s)", err.Error())
+	b, ok := channelBackends[Conf().ChannelType]
+	if !ok {
+		LogError(LogLevelErr, "unknown channel type : %d (%s)", Conf().ChannelType, channelBackendNames())
+		return nil
+	}
+
+	if b.Init != nil {
+		if err := b.Init(l); err != nil {
+			LogError(LogLevelErr, "init %s failed (%s)", b.Name, err.Error())
 			return nil
 		}
 	}
@@ -89,7 +113,7 @@ func NewChannelList() *ChannelList {
 func (l *ChannelList) bucket(key string) *channelBucket {
 	h := hash.NewMurmur3C()
 	h.Write([]byte(key))
-	idx := uint(h.Sum32()) & uint(Conf.ChannelBucket-1)
+	idx := uint(h.Sum32()) & uint(Conf().ChannelBucket-1)
 	return l.channels[idx]
 }
 
@@ -101,23 +125,148 @@ func (l *ChannelList) New(key string) (Channel, error) {
 
 	if c, ok := b.data[key]; ok {
 		// refresh the expire time
-		c.SetDeadline(time.Now().UnixNano() + Conf.ChannelExpireSec*Second)
+		c.SetDeadline(time.Now().UnixNano() + Conf().ChannelExpireSec*Second)
+		chStat.IncrRefreshed()
 		return c, nil
 	} else {
-		if Conf.ChannelType == InnerChannelType {
-			c = NewInnerChannel()
-		} else if Conf.ChannelType == RedisChannelType {
-			c = NewRedisChannel()
-		} else {
-			LogError(LogLevelErr, "unknown channel type : %d (0: inner_channel, 1: redis_channel)", Conf.ChannelType)
+		cb, ok := channelBackends[Conf().ChannelType]
+		if !ok {
+			LogError(LogLevelErr, "unknown channel type : %d (%s)", Conf().ChannelType, channelBackendNames())
 			return nil, ChannelTypeErr
 		}
 
+		store, token, err := cb.New(key)
+		if err != nil {
+			return nil, err
+		}
+
+		c = NewStoreChannel(key, store, token)
 		b.data[key] = c
+		chStat.IncrCreated()
 		return c, nil
 	}
 }
 
+// put add a created channel, used by the backends restore the stored keys
+func (l *ChannelList) put(key string, c Channel) {
+	b := l.bucket(key)
+	b.mutex.Lock()
+	b.data[key] = c
+	b.mutex.Unlock()
+	chStat.IncrCreated()
+}
+
+// StartSweeper start a goroutine sweep the expired channels and messages
+// every Conf().ChannelSweepSec seconds till shutdown, 0 pause it.
+func (l *ChannelList) StartSweeper() {
+	if Conf().ChannelSweepSec <= 0 {
+		LogError(LogLevelWarn, "channel sweeper disabled")
+	}
+
+	go func() {
+		// check every second, so the reloaded interval applied and the
+		// sweeper stopped soon after shutdown
+		last := time.Now()
+		for !isShutdown() {
+			time.Sleep(time.Second)
+			sec := Conf().ChannelSweepSec
+			if sec <= 0 || time.Now().Sub(last) < time.Duration(sec)*time.Second || isShutdown() {
+				continue
+			}
+
+			l.sweep()
+			last = time.Now()
+		}
+	}()
+}
+
+// sweep walk every bucket, delete and close the expired channels, purge the
+// expired messages of the alive channels. The bucket mutex only hold for
+// one batch of keys, so pub/sub won't block by a large bucket.
+func (l *ChannelList) sweep() {
+	batch := Conf().ChannelSweepBatch
+	if batch <= 0 {
+		batch = 1
+	}
+
+	swept, purged := 0, 0
+	begin := time.Now()
+	for _, b := range l.channels {
+		// snapshot the keys
+		b.mutex.Lock()
+		keys := make([]string, 0, len(b.data))
+		for key, _ := range b.data {
+			keys = append(keys, key)
+		}
+
+		b.mutex.Unlock()
+		for i := 0; i < len(keys); i += batch {
+			j := i + batch
+			if j > len(keys) {
+				j = len(keys)
+			}
+
+			expired := map[string]Channel{}
+			alive := map[string]Channel{}
+			b.mutex.Lock()
+			for _, key := range keys[i:j] {
+				c, ok := b.data[key]
+				if !ok {
+					// already deleted by Get
+					continue
+				}
+
+				if c.Timeout() {
+					delete(b.data, key)
+					expired[key] = c
+				} else {
+					alive[key] = c
+				}
+			}
+
+			b.mutex.Unlock()
+			// close or purge out of the bucket mutex
+			for key, c := range expired {
+				LogError(LogLevelInfo, "device:%s channel expired, swept", key)
+				if err := c.Close(); err != nil {
+					LogError(LogLevelErr, "device:%s channel close failed (%s)", key, err.Error())
+				}
+
+				chStat.IncrExpired()
+				chStat.IncrSwept()
+				swept++
+			}
+
+			for key, c := range alive {
+				n := c.Purge(key)
+				chStat.AddPurgedMsg(uint64(n))
+				purged += n
+			}
+		}
+	}
+
+	LogError(LogLevelInfo, "channel sweep %d channels, %d messages in %s", swept, purged, time.Now().Sub(begin).String())
+}
+
+// Range call f for every unexpired channel, the bucket mutex only hold for
+// fetching the channels, f called out of the mutex.
+func (l *ChannelList) Range(f func(key string, c Channel)) {
+	for _, b := range l.channels {
+		b.mutex.Lock()
+		chs := make(map[string]Channel, len(b.data))
+		for key, c := range b.data {
+			if !c.Timeout() {
+				chs[key] = c
+			}
+		}
+
+		b.mutex.Unlock()
+		for key, c := range chs {
+			f(key, c)
+		}
+	}
+}
+
 // get a subscriber from channel in pub/sub action
 func (l *ChannelList) Get(key string) (Channel, error) {
 	// get a channel bucket
@@ -132,6 +281,7 @@ func (l *ChannelList) Get(key string) (Channel, error) {
 		if c.Timeout() {
 			LogError(LogLevelWarn, "device:%s channle expired", key)
 			delete(b.data, key)
+			chStat.IncrExpired()
 			if err := c.Close(); err != nil {
 				return nil, err
 			}
@@ -7,7 +7,7 @@ import (
 )
 
 func Client(w http.ResponseWriter, r *http.Request) {
-	addr := Conf.Addr
+	addr := Conf().WebsocketAddr
 	if addr == "" {
 		addr = "localhost:8080"
 	}
@@ -0,0 +1,351 @@
+// Package client is the gopush2 subscriber client, it speaks both the tcp and
+// the websocket protocol, sends the heartbeat, reconnects with backoff and
+// resumes from the last received message id.
+//
+//	c := client.New(&client.Options{Proto: client.TCPProtocol, Addr: "127.0.0.1:8080", Keys: []*client.Key{&client.Key{Key: "Terry-Mao"}}})
+//	defer c.Close()
+//	for m := range c.Messages() {
+//		fmt.Println(m.Key, m.MsgID, m.Msg)
+//	}
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Same as the gopush2 protocol numbers
+	WebsocketProtocol = 0
+	TCPProtocol       = 1
+	heartbeatMsg      = "h"
+	reconnectMsg      = "r"
+	defaultHeartbeat  = 30 * time.Second
+	defaultMinBackoff = 1 * time.Second
+	defaultMaxBackoff = 60 * time.Second
+	defaultMsgBuf     = 1024
+	defaultDialTime   = 10 * time.Second
+)
+
+var (
+	// Client closed
+	ClosedErr = errors.New("client closed")
+	// Frame format error
+	FrameFmtErr = errors.New("frame format error")
+	// Server asked reconnect
+	ReconnectErr = errors.New("server asked reconnect")
+	// Unknown protocol
+	ProtoErr = errors.New("unknown protocol")
+	// Subscribe keys empty
+	NoKeyErr = errors.New("no key subscribed")
+
+	// status or integer reply, skipped
+	errReply = errors.New("reply")
+
+	heartbeatBytes = []byte(heartbeatMsg)
+)
+
+// ReplyErr is the -ERR reply of the server.
+type ReplyErr string
+
+func (e ReplyErr) Error() string {
+	return "gopush2: " + string(e)
+}
+
+// Message is the message received from the gopush2.
+type Message struct {
+	// Subscribed key
+	Key string `json:"key"`
+	// Message
+	Msg string `json:"msg"`
+	// Message id
+	MsgID int64 `json:"mid"`
+}
+
+// Key is a subscribed key.
+type Key struct {
+	// Subscriber key
+	Key string
+	// Resume from the message id, the messages after it will be received
+	MsgID int64
+	// Auth token
+	Token string
+}
+
+// Options is the client options.
+type Options struct {
+	// WebsocketProtocol or TCPProtocol
+	Proto int
+	// Server address, host:port
+	Addr string
+	// Subscribed keys
+	Keys []*Key
+	// Heartbeat period, the server timedout the conn after twice of it
+	Heartbeat time.Duration
+	// Reconnect backoff, doubled after every failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Dial timeout
+	DialTimeout time.Duration
+	// Messages channel buffer
+	MsgBuf int
+	// Logger, discard if nil
+	Logger *log.Logger
+}
+
+// Client is the gopush2 subscriber, it keeps subscribing till closed.
+type Client struct {
+	opts   Options
+	msgs   chan *Message
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	conn   net.Conn
+	mids   map[string]int64
+	tokens map[string]string
+	keys   []string
+}
+
+// conn is the protocol conn.
+type conn interface {
+	net.Conn
+	// sub subscribe the keys and wait the ready heartbeat
+	sub(keys []*Key, heartbeat time.Duration) error
+	// read read a message, nil message if heartbeat
+	read() (*Message, error)
+	// heartbeat send a heartbeat
+	heartbeat() error
+}
+
+// New create a client and start subscribing in a goroutine, the messages
+// are received from Messages.
+func New(opts *Options) *Client {
+	c := &Client{
+		opts:   *opts,
+		done:   make(chan struct{}),
+		mids:   map[string]int64{},
+		tokens: map[string]string{},
+	}
+
+	if c.opts.Heartbeat <= 0 {
+		c.opts.Heartbeat = defaultHeartbeat
+	}
+
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = defaultMinBackoff
+	}
+
+	if c.opts.MaxBackoff < c.opts.MinBackoff {
+		c.opts.MaxBackoff = defaultMaxBackoff
+		if c.opts.MaxBackoff < c.opts.MinBackoff {
+			c.opts.MaxBackoff = c.opts.MinBackoff
+		}
+	}
+
+	if c.opts.DialTimeout <= 0 {
+		c.opts.DialTimeout = defaultDialTime
+	}
+
+	if c.opts.MsgBuf <= 0 {
+		c.opts.MsgBuf = defaultMsgBuf
+	}
+
+	if c.opts.Logger == nil {
+		c.opts.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	for _, k := range opts.Keys {
+		c.keys = append(c.keys, k.Key)
+		c.mids[k.Key] = k.MsgID
+		c.tokens[k.Key] = k.Token
+	}
+
+	c.msgs = make(chan *Message, c.opts.MsgBuf)
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// Messages return the received messages, closed after the client closed.
+func (c *Client) Messages() <-chan *Message {
+	return c.msgs
+}
+
+// LastMsgID return the last received message id of the key.
+func (c *Client) LastMsgID(key string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.mids[key]
+}
+
+// Close stop subscribing and close the conn.
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.lock.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.lock.Unlock()
+	})
+
+	c.wg.Wait()
+	return nil
+}
+
+// run keep subscribing till closed
+func (c *Client) run() {
+	defer c.wg.Done()
+	defer close(c.msgs)
+	if len(c.keys) == 0 {
+		c.opts.Logger.Printf("gopush2: %s", NoKeyErr)
+		return
+	}
+
+	backoff := c.opts.MinBackoff
+	for {
+		subed, err := c.serve()
+		if c.closed() {
+			return
+		}
+
+		c.opts.Logger.Printf("gopush2: %s subscribe failed (%s)", c.opts.Addr, err)
+		// subscribed once, the server alive, reconnect at once
+		if subed {
+			backoff = c.opts.MinBackoff
+			if err == ReconnectErr {
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// serve dial and subscribe, then read the messages till error, subed is
+// true if subscribed.
+func (c *Client) serve() (subed bool, err error) {
+	var conn conn
+
+	switch c.opts.Proto {
+	case TCPProtocol:
+		conn, err = dialTCP(c.opts.Addr, c.opts.DialTimeout)
+	case WebsocketProtocol:
+		conn, err = dialWebsocket(c.opts.Addr, c.subKeys(), c.opts.Heartbeat, c.opts.DialTimeout)
+	default:
+		return false, ProtoErr
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close()
+	if !c.setConn(conn) {
+		return false, ClosedErr
+	}
+
+	defer c.setConn(nil)
+	if err = conn.sub(c.subKeys(), c.opts.Heartbeat); err != nil {
+		return false, err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.heartbeat(conn, stop)
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(c.opts.Heartbeat * 2)); err != nil {
+			return true, err
+		}
+
+		m, err := conn.read()
+		if err != nil {
+			return true, err
+		}
+
+		// heartbeat
+		if m == nil {
+			continue
+		}
+
+		// the untagged frame
+		if m.Key == "" && len(c.keys) == 1 {
+			m.Key = c.keys[0]
+		}
+
+		c.lock.Lock()
+		if m.MsgID > c.mids[m.Key] {
+			c.mids[m.Key] = m.MsgID
+		}
+		c.lock.Unlock()
+		select {
+		case c.msgs <- m:
+		case <-c.done:
+			return true, ClosedErr
+		}
+	}
+}
+
+// heartbeat send the heartbeat period till stop
+func (c *Client) heartbeat(conn conn, stop chan struct{}) {
+	t := time.NewTicker(c.opts.Heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := conn.heartbeat(); err != nil {
+				c.opts.Logger.Printf("gopush2: %s heartbeat failed (%s)", c.opts.Addr, err)
+				conn.Close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// setConn save the current conn for Close, return false if closed.
+func (c *Client) setConn(conn net.Conn) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if conn != nil && c.closed() {
+		return false
+	}
+
+	c.conn = conn
+	return true
+}
+
+// subKeys return the keys resumed from the last message ids
+func (c *Client) subKeys() []*Key {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]*Key, 0, len(c.keys))
+	for _, key := range c.keys {
+		keys = append(keys, &Key{Key: key, MsgID: c.mids[key], Token: c.tokens[key]})
+	}
+
+	return keys
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadTCPFrame(t *testing.T) {
+	frames := "h" +
+		"$22\r\n{\"mid\":1,\"msg\":\"test\"}\r\n" +
+		"*2\r\n$9\r\nTerry-Mao\r\n$22\r\n{\"mid\":2,\"msg\":\"test\"}\r\n" +
+		"+OK\r\n" +
+		"-ERR mid argument error\r\n" +
+		"r" +
+		"$5\r\nbroken"
+	tests := []struct {
+		m   *Message
+		err error
+	}{
+		{nil, nil},
+		{&Message{MsgID: 1, Msg: "test"}, nil},
+		{&Message{Key: "Terry-Mao", MsgID: 2, Msg: "test"}, nil},
+		{nil, errReply},
+		{nil, ReplyErr("ERR mid argument error")},
+		{nil, ReconnectErr},
+		{nil, FrameFmtErr},
+	}
+
+	rd := bufio.NewReader(strings.NewReader(frames))
+	for i, test := range tests {
+		m, err := readTCPFrame(rd)
+		if err != test.err && !(test.err == FrameFmtErr && err != nil) {
+			t.Errorf("frame %d error must be %v, but %v", i, test.err, err)
+			continue
+		}
+
+		if (m == nil) != (test.m == nil) || (m != nil && *m != *test.m) {
+			t.Errorf("frame %d message must be %v, but %v", i, test.m, m)
+		}
+	}
+}
+
+func TestEncodeCmd(t *testing.T) {
+	cmd := string(encodeCmd([]string{"msub", "10", "Terry-Mao", "0", ""}))
+	if cmd != "*5\r\n$4\r\nmsub\r\n$2\r\n10\r\n$9\r\nTerry-Mao\r\n$1\r\n0\r\n$0\r\n\r\n" {
+		t.Errorf("cmd %q error", cmd)
+	}
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// tcpConn is the redis protocol conn of gopush2.
+type tcpConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func dialTCP(addr string, timeout time.Duration) (*tcpConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpConn{Conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// sub implements the conn sub method.
+func (c *tcpConn) sub(keys []*Key, heartbeat time.Duration) error {
+	args := make([]string, 0, 2+len(keys)*3)
+	args = append(args, "msub", strconv.Itoa(int(heartbeat/time.Second)))
+	for _, k := range keys {
+		args = append(args, k.Key, strconv.FormatInt(k.MsgID, 10), k.Token)
+	}
+
+	if err := c.SetDeadline(time.Now().Add(heartbeat)); err != nil {
+		return err
+	}
+
+	if _, err := c.Write(encodeCmd(args)); err != nil {
+		return err
+	}
+
+	// wait the ready heartbeat
+	m, err := readTCPFrame(c.rd)
+	if err != nil {
+		return err
+	}
+
+	if m != nil {
+		return FrameFmtErr
+	}
+
+	return c.SetDeadline(time.Time{})
+}
+
+// read implements the conn read method.
+func (c *tcpConn) read() (*Message, error) {
+	for {
+		m, err := readTCPFrame(c.rd)
+		if err != errReply {
+			return m, err
+		}
+	}
+}
+
+// heartbeat implements the conn heartbeat method.
+func (c *tcpConn) heartbeat() error {
+	_, err := c.Write(heartbeatBytes)
+	return err
+}
+
+// encodeCmd encode the args as a redis protocol command
+func encodeCmd(args []string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("*")
+	buf.WriteString(strconv.Itoa(len(args)))
+	buf.WriteString("\r\n")
+	for _, arg := range args {
+		buf.WriteString("$")
+		buf.WriteString(strconv.Itoa(len(arg)))
+		buf.WriteString("\r\n")
+		buf.WriteString(arg)
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+// readTCPFrame read a frame, the frames are:
+// heartbeat: h
+// reconnect: r
+// message: $size\r\njson\r\n
+// tagged message: *2\r\n$klen\r\nkey\r\n$size\r\njson\r\n
+// reply: +OK\r\n, :n\r\n, -ERR message\r\n
+// A nil message returned if heartbeat, errReply if a status or integer reply,
+// ReplyErr if an error reply.
+func readTCPFrame(rd *bufio.Reader) (*Message, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case heartbeatMsg[0]:
+		return nil, nil
+	case reconnectMsg[0]:
+		return nil, ReconnectErr
+	case '$':
+		data, err := readBulk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeMsg(data)
+	case '*':
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		if string(line) != "2" {
+			return nil, FrameFmtErr
+		}
+
+		key, err := readTagBulk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := readTagBulk(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := decodeMsg(data)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Key = string(key)
+		return m, nil
+	case '+', ':':
+		if _, err = readLine(rd); err != nil {
+			return nil, err
+		}
+
+		return nil, errReply
+	case '-':
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ReplyErr(line)
+	default:
+		return nil, FrameFmtErr
+	}
+}
+
+// readTagBulk read a $size\r\ndata\r\n
+func readTagBulk(rd *bufio.Reader) ([]byte, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if b != '$' {
+		return nil, FrameFmtErr
+	}
+
+	return readBulk(rd)
+}
+
+// readBulk read a size\r\ndata\r\n, the $ already read
+func readBulk(rd *bufio.Reader) ([]byte, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.Atoi(string(line))
+	if err != nil || size < 0 {
+		return nil, FrameFmtErr
+	}
+
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(rd, data); err != nil {
+		return nil, err
+	}
+
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, FrameFmtErr
+	}
+
+	return data[:size], nil
+}
+
+// readLine read a line end with \r\n, the \r\n trimed
+func readLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, FrameFmtErr
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// decodeMsg decode the message json
+func decodeMsg(data []byte) (*Message, error) {
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// websocketConn is the websocket conn of gopush2.
+type websocketConn struct {
+	*websocket.Conn
+}
+
+// dialWebsocket dial the websocket with the subscribed keys.
+func dialWebsocket(addr string, keys []*Key, heartbeat, timeout time.Duration) (*websocketConn, error) {
+	params := url.Values{}
+	params.Set("heartbeat", strconv.Itoa(int(heartbeat/time.Second)))
+	for _, k := range keys {
+		params.Add("key", k.Key)
+		params.Add("mid", strconv.FormatInt(k.MsgID, 10))
+		params.Add("token", k.Token)
+	}
+
+	conf, err := websocket.NewConfig("ws://"+addr+"/msub?"+params.Encode(), "http://"+addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(conf, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{Conn: ws}, nil
+}
+
+// sub implements the conn sub method, the keys already subscribed when
+// dialing, only wait the ready heartbeat.
+func (c *websocketConn) sub(keys []*Key, heartbeat time.Duration) error {
+	if err := c.SetDeadline(time.Now().Add(heartbeat)); err != nil {
+		return err
+	}
+
+	m, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	if m != nil {
+		return FrameFmtErr
+	}
+
+	return c.SetDeadline(time.Time{})
+}
+
+// read implements the conn read method.
+func (c *websocketConn) read() (*Message, error) {
+	data := ""
+	if err := websocket.Message.Receive(c.Conn, &data); err != nil {
+		return nil, err
+	}
+
+	return readWebsocketFrame(data)
+}
+
+// heartbeat implements the conn heartbeat method.
+func (c *websocketConn) heartbeat() error {
+	return websocket.Message.Send(c.Conn, heartbeatMsg)
+}
+
+// readWebsocketFrame decode a websocket frame, the frames are:
+// heartbeat: h
+// reconnect: r
+// message: json
+// A nil message returned if heartbeat.
+func readWebsocketFrame(data string) (*Message, error) {
+	switch data {
+	case heartbeatMsg:
+		return nil, nil
+	case reconnectMsg:
+		return nil, ReconnectErr
+	default:
+		return decodeMsg([]byte(data))
+	}
+}
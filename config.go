@@ -5,12 +5,44 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
-	Conf     *Config
+	// the current config, replaced by reload, read by Conf()
+	conf     atomic.Value
 	ConfFile string
+	// reload config lock
+	reloadMutex = &sync.Mutex{}
+	// the config keys can be reloaded at runtime
+	reloadableKeys = map[string]bool{
+		"message_expire_sec":     true,
+		"channel_expire_sec":     true,
+		"channel_sweep_sec":      true,
+		"channel_sweep_batch":    true,
+		"max_stored_message":     true,
+		"max_subscriber_per_key": true,
+		"max_sub_key_per_conn":   true,
+		"max_conn":               true,
+		"max_conn_per_ip":        true,
+		"write_queue_size":       true,
+		"write_queue_policy":     true,
+		"write_timeout_sec":      true,
+		"heartbeat_sec":          true,
+		"shutdown_drain_sec":     true,
+		"shutdown_reconnect":     true,
+		"redis":                  true,
+		"redis_check_sec":        true,
+		"redis_fallback":         true,
+		"log_level":              true,
+		"tcp_pub":                true,
+		"auth_keys":              true,
+		"file_max_open":          true,
+	}
 )
 
 func init() {
@@ -23,34 +55,69 @@ type RedisConfig struct {
 	Timeout int    `json:"timeout"`
 	Active  int    `json:"active"`
 	Idle    int    `json:"idle"`
+	// Ketama weight, 0 means 1
+	Weight int `json:"weight"`
 }
 
 type Config struct {
 	Node                string                  `json:"node"`
 	Addr                string                  `json:"addr"`
+	TCPAddr             string                  `json:"tcp_addr"`
+	WebsocketAddr       string                  `json:"websocket_addr"`
 	AdminAddr           string                  `json:"admin_addr"`
 	Log                 string                  `json:"log"`
 	MessageExpireSec    int64                   `json:"message_expire_sec"`
 	ChannelExpireSec    int64                   `json:"channel_expire_sec"`
+	ChannelSweepSec     int64                   `json:"channel_sweep_sec"`
+	ChannelSweepBatch   int                     `json:"channel_sweep_batch"`
 	MaxStoredMessage    int                     `json:"max_stored_message"`
 	MaxProcs            int                     `json:"max_procs"`
 	MaxSubscriberPerKey int                     `json:"max_subscriber_per_key"`
+	MaxSubKeyPerConn    int                     `json:"max_sub_key_per_conn"`
+	MaxConn             int                     `json:"max_conn"`
+	MaxConnPerIP        int                     `json:"max_conn_per_ip"`
 	TCPKeepAlive        int                     `json:"tcp_keepalive"`
 	ChannelBucket       int                     `json:"channel_bucket"`
 	ChannelType         int                     `json:"channel_type"`
 	HeartbeatSec        int                     `json:"heartbeat_sec"`
+	NodeHeartbeatSec    int                     `json:"node_heartbeat_sec"`
+	ShutdownDrainSec    int                     `json:"shutdown_drain_sec"`
+	ShutdownReconnect   int                     `json:"shutdown_reconnect"`
 	Auth                int                     `json:"auth"`
+	AuthKeys            map[string]string       `json:"auth_keys"`
+	TCPPub              int                     `json:"tcp_pub"`
 	Redis               map[string]*RedisConfig `json:"redis"`
+	FileDir             string                  `json:"file_dir"`
+	FileSync            int                     `json:"file_sync"`
+	FileMaxOpen         int                     `json:"file_max_open"`
+	SnapshotFile        string                  `json:"snapshot_file"`
+	SnapshotSec         int                     `json:"snapshot_sec"`
+	RedisCheckSec       int                     `json:"redis_check_sec"`
+	RedisFallback       int                     `json:"redis_fallback"`
 	ReadBufInstance     int                     `json:"read_buf_instance"`
 	ReadBufNumPerInst   int                     `json:"read_buf_num_per_inst"`
 	ReadBufByte         int                     `json:"read_buf_byte"`
 	WriteBufNum         int                     `json:"write_buf_num"`
 	WriteBufByte        int                     `json:"write_buf_byte"`
+	WriteQueueSize      int                     `json:"write_queue_size"`
+	WriteQueuePolicy    int                     `json:"write_queue_policy"`
+	WriteTimeoutSec     int                     `json:"write_timeout_sec"`
 	Protocol            int                     `json:"protocol"`
 	LogLevel            int                     `json:"log_level"`
 	Debug               int                     `json:"debug"`
 }
 
+// Conf get the current config, the returned config must not be modified
+func Conf() *Config {
+	c, _ := conf.Load().(*Config)
+	return c
+}
+
+// SetConf replace the current config
+func SetConf(c *Config) {
+	conf.Store(c)
+}
+
 // get a config
 func NewConfig(file string) (*Config, error) {
 	c, err := ioutil.ReadFile(file)
@@ -66,21 +133,41 @@ func NewConfig(file string) (*Config, error) {
 		//Pprof:               1,
 		MessageExpireSec:    10800,  // 3 hour
 		ChannelExpireSec:    604800, // 24 * 7 hour
+		ChannelSweepSec:     60,     // 0 disable the sweeper
+		ChannelSweepBatch:   100,
 		Log:                 "./gopush.log",
 		MaxStoredMessage:    20,
 		MaxSubscriberPerKey: 0, // no limit
+		MaxSubKeyPerConn:    16,
+		MaxConn:             0, // no limit
+		MaxConnPerIP:        0, // no limit
 		MaxProcs:            runtime.NumCPU(),
 		TCPKeepAlive:        1,
 		ChannelBucket:       16,
 		ChannelType:         0,
 		HeartbeatSec:        30,
-		Auth:                1,
+		NodeHeartbeatSec:    10,
+		ShutdownDrainSec:    5,
+		ShutdownReconnect:   0,
+		Auth:                AuthStored,
+		AuthKeys:            nil,
+		TCPPub:              0,
 		Redis:               nil,
+		FileDir:             "./data",
+		FileSync:            0,
+		FileMaxOpen:         1024,
+		SnapshotFile:        "", // disable the snapshot
+		SnapshotSec:         300,
+		RedisCheckSec:       5,
+		RedisFallback:       RedisFallbackNext,
 		ReadBufInstance:     runtime.NumCPU(),
 		ReadBufNumPerInst:   1024,
 		ReadBufByte:         512,
 		WriteBufNum:         1024,
 		WriteBufByte:        512,
+		WriteQueueSize:      64,
+		WriteQueuePolicy:    WriteQueueDropOldest,
+		WriteTimeoutSec:     5,
 		Protocol:            0,
 		LogLevel:            0,
 		Debug:               0,
@@ -91,5 +178,325 @@ func NewConfig(file string) (*Config, error) {
 		return nil, err
 	}
 
+	// compatible with the single protocol config "addr" and "protocol"
+	if cf.TCPAddr == "" && cf.WebsocketAddr == "" {
+		if cf.Protocol == TCPProtocol {
+			cf.TCPAddr = cf.Addr
+		} else if cf.Protocol == WebsocketProtocol {
+			cf.WebsocketAddr = cf.Addr
+		}
+	}
+
 	return cf, nil
 }
+
+// ConfigError is all the problems found by Config.Validate
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Validate check all the config values and the cross-field invariants,
+// normalize the defaults. Return a ConfigError contains every problem.
+func (c *Config) Validate() error {
+	errs := ConfigError{}
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// normalize defaults
+	if c.ChannelType == 0 {
+		c.ChannelType = InnerChannelType
+	}
+
+	if c.MaxProcs == 0 {
+		c.MaxProcs = runtime.NumCPU()
+	}
+
+	if c.ReadBufInstance == 0 {
+		c.ReadBufInstance = runtime.NumCPU()
+	}
+
+	// address
+	if c.Node == "" {
+		add("\"node\" must be set")
+	}
+
+	if c.TCPAddr == "" && c.WebsocketAddr == "" {
+		add("\"tcp_addr\" or \"websocket_addr\" must be set (or \"addr\" with \"protocol\" 0: websocket, 1: tcp)")
+	}
+
+	if c.Protocol != WebsocketProtocol && c.Protocol != TCPProtocol {
+		add("\"protocol\" %d not support (0: websocket, 1: tcp)", c.Protocol)
+	}
+
+	if c.AdminAddr == "" {
+		add("\"admin_addr\" must be set")
+	} else if c.AdminAddr == c.TCPAddr || c.AdminAddr == c.WebsocketAddr {
+		add("\"admin_addr\" %s equals the subscriber addr is not allowed for security reason", c.AdminAddr)
+	}
+
+	if c.TCPAddr != "" && c.TCPAddr == c.WebsocketAddr {
+		add("\"tcp_addr\" equals \"websocket_addr\" %s", c.TCPAddr)
+	}
+
+	// channel
+	if c.ChannelBucket <= 0 || c.ChannelBucket&(c.ChannelBucket-1) != 0 {
+		add("\"channel_bucket\" %d must be a power of two", c.ChannelBucket)
+	}
+
+	if _, ok := channelBackends[c.ChannelType]; !ok {
+		add("\"channel_type\" %d not support (%s)", c.ChannelType, channelBackendNames())
+	}
+
+	if c.ChannelExpireSec <= 0 {
+		add("\"channel_expire_sec\" %d must greate than 0", c.ChannelExpireSec)
+	}
+
+	if c.ChannelSweepSec < 0 {
+		add("\"channel_sweep_sec\" %d must not less than 0", c.ChannelSweepSec)
+	}
+
+	if c.ChannelSweepBatch <= 0 {
+		add("\"channel_sweep_batch\" %d must greate than 0", c.ChannelSweepBatch)
+	}
+
+	// message
+	if c.MessageExpireSec <= 0 {
+		add("\"message_expire_sec\" %d must greate than 0", c.MessageExpireSec)
+	}
+
+	if c.MaxStoredMessage <= 0 {
+		add("\"max_stored_message\" %d must greate than 0", c.MaxStoredMessage)
+	}
+
+	// subscriber
+	if c.MaxSubscriberPerKey < 0 {
+		add("\"max_subscriber_per_key\" %d must not less than 0 (0: no limit)", c.MaxSubscriberPerKey)
+	}
+
+	if c.MaxSubKeyPerConn < 0 {
+		add("\"max_sub_key_per_conn\" %d must not less than 0 (0: no limit)", c.MaxSubKeyPerConn)
+	}
+
+	if c.MaxConn < 0 {
+		add("\"max_conn\" %d must not less than 0 (0: no limit)", c.MaxConn)
+	}
+
+	if c.MaxConnPerIP < 0 {
+		add("\"max_conn_per_ip\" %d must not less than 0 (0: no limit)", c.MaxConnPerIP)
+	}
+
+	if c.HeartbeatSec <= 0 {
+		add("\"heartbeat_sec\" %d must greate than 0", c.HeartbeatSec)
+	}
+
+	if c.NodeHeartbeatSec <= 0 {
+		add("\"node_heartbeat_sec\" %d must greate than 0", c.NodeHeartbeatSec)
+	}
+
+	if c.ShutdownDrainSec < 0 {
+		add("\"shutdown_drain_sec\" %d must not less than 0", c.ShutdownDrainSec)
+	}
+
+	// switch
+	if c.Auth != AuthNone && c.Auth != AuthStored && c.Auth != AuthSigned {
+		add("\"auth\" %d not support (0: none, 1: stored token, 2: signed token)", c.Auth)
+	}
+
+	if c.Auth == AuthSigned && len(c.AuthKeys) == 0 {
+		add("\"auth_keys\" must be set when \"auth\" is 2")
+	}
+
+	for kid, secret := range c.AuthKeys {
+		if len(secret) < authKeyMinLen {
+			add("\"auth_keys\" key:%s secret must not less than %d bytes", kid, authKeyMinLen)
+		}
+	}
+
+	if c.TCPPub != 0 && c.TCPPub != 1 {
+		add("\"tcp_pub\" %d must be 0 or 1", c.TCPPub)
+	}
+
+	if c.TCPKeepAlive != 0 && c.TCPKeepAlive != 1 {
+		add("\"tcp_keepalive\" %d must be 0 or 1", c.TCPKeepAlive)
+	}
+
+	if c.ShutdownReconnect != 0 && c.ShutdownReconnect != 1 {
+		add("\"shutdown_reconnect\" %d must be 0 or 1", c.ShutdownReconnect)
+	}
+
+	if c.Debug != 0 && c.Debug != 1 {
+		add("\"debug\" %d must be 0 or 1", c.Debug)
+	}
+
+	if c.LogLevel < LogLevelErr || c.LogLevel > LogLevelDebug {
+		add("\"log_level\" %d not support (0: error, 1: warn, 2: info, 3: debug)", c.LogLevel)
+	}
+
+	// buffer
+	if c.MaxProcs < 0 {
+		add("\"max_procs\" %d must not less than 0", c.MaxProcs)
+	}
+
+	if c.ReadBufInstance < 0 || c.ReadBufNumPerInst <= 0 || c.ReadBufByte <= 0 {
+		add("\"read_buf_instance\" %d, \"read_buf_num_per_inst\" %d, \"read_buf_byte\" %d must greate than 0", c.ReadBufInstance, c.ReadBufNumPerInst, c.ReadBufByte)
+	}
+
+	if c.WriteBufNum <= 0 || c.WriteBufByte <= 0 {
+		add("\"write_buf_num\" %d, \"write_buf_byte\" %d must greate than 0", c.WriteBufNum, c.WriteBufByte)
+	}
+
+	if c.WriteQueueSize < c.MaxStoredMessage {
+		add("\"write_queue_size\" %d must not less than \"max_stored_message\" %d", c.WriteQueueSize, c.MaxStoredMessage)
+	}
+
+	if c.WriteQueuePolicy != WriteQueueDropOldest && c.WriteQueuePolicy != WriteQueueDropNewest && c.WriteQueuePolicy != WriteQueueDisconnect {
+		add("\"write_queue_policy\" %d not support (0: drop oldest, 1: drop newest, 2: disconnect)", c.WriteQueuePolicy)
+	}
+
+	if c.WriteTimeoutSec <= 0 {
+		add("\"write_timeout_sec\" %d must greate than 0", c.WriteTimeoutSec)
+	}
+
+	// redis
+	if c.ChannelType == RedisChannelType && len(c.Redis) == 0 {
+		add("\"redis\" must be set when \"channel_type\" is 2")
+	}
+
+	// file
+	if c.ChannelType == FileChannelType && c.FileDir == "" {
+		add("\"file_dir\" must be set when \"channel_type\" is 3")
+	}
+
+	if c.FileSync != 0 && c.FileSync != 1 {
+		add("\"file_sync\" %d must be 0 or 1", c.FileSync)
+	}
+
+	if c.FileMaxOpen < 0 {
+		add("\"file_max_open\" %d must not less than 0 (0: no limit)", c.FileMaxOpen)
+	}
+
+	if c.SnapshotSec < 0 {
+		add("\"snapshot_sec\" %d must not less than 0 (0: only on shutdown)", c.SnapshotSec)
+	}
+
+	if c.RedisCheckSec <= 0 {
+		add("\"redis_check_sec\" %d must greate than 0", c.RedisCheckSec)
+	}
+
+	if c.RedisFallback != RedisFallbackNext && c.RedisFallback != RedisFallbackReadOnly {
+		add("\"redis_fallback\" %d not support (0: next node, 1: read-only)", c.RedisFallback)
+	}
+
+	for n, r := range c.Redis {
+		if r == nil {
+			add("\"redis\" node %s not set", n)
+			continue
+		}
+
+		if r.Network == "" || r.Addr == "" {
+			add("\"redis\" node %s \"network\" and \"addr\" must be set", n)
+		}
+
+		if r.Active < 0 || r.Idle < 0 || r.Timeout < 0 {
+			add("\"redis\" node %s \"active\" %d, \"idle\" %d, \"timeout\" %d must not less than 0", n, r.Active, r.Idle, r.Timeout)
+		}
+
+		if r.Weight < 0 {
+			add("\"redis\" node %s \"weight\" %d must not less than 0", n, r.Weight)
+		} else if r.Weight == 0 {
+			r.Weight = 1
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// ReloadConfig reload the config file, apply the reloadable keys and return
+// the applied keys and the changed keys which need restart. If the config
+// file is invalid, nothing applied.
+func ReloadConfig() ([]string, []string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	nc, err := NewConfig(ConfFile)
+	if err != nil {
+		LogError(LogLevelErr, "NewConfig(\"%s\") failed (%s)", ConfFile, err.Error())
+		return nil, nil, err
+	}
+
+	if err = nc.Validate(); err != nil {
+		LogError(LogLevelErr, "reload config rejected (%s)", err.Error())
+		return nil, nil, err
+	}
+
+	applied, restart := []string{}, []string{}
+	// copy the current config, only set the reloadable keys
+	cur := Conf()
+	rc := *cur
+	ov := reflect.ValueOf(cur).Elem()
+	nv := reflect.ValueOf(nc).Elem()
+	rv := reflect.ValueOf(&rc).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		key := nv.Type().Field(i).Tag.Get("json")
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+
+		if key == "redis" {
+			// only the pool size can be reloaded
+			if !redisPoolReloadable(cur.Redis, nc.Redis) {
+				restart = append(restart, key)
+				continue
+			}
+
+			reloadRedisPool(nc.Redis)
+		} else if _, ok := reloadableKeys[key]; !ok {
+			restart = append(restart, key)
+			continue
+		}
+
+		rv.Field(i).Set(nv.Field(i))
+		applied = append(applied, key)
+	}
+
+	// apply the config which copied at startup
+	if rc.LogLevel != cur.LogLevel {
+		SetLogLevel(rc.LogLevel)
+	}
+
+	SetConf(&rc)
+	if rc.MaxStoredMessage != cur.MaxStoredMessage && channel != nil {
+		channel.Range(func(key string, c Channel) {
+			if ic, ok := c.(interface {
+				SetMaxMessage(int)
+			}); ok {
+				ic.SetMaxMessage(rc.MaxStoredMessage)
+			}
+		})
+	}
+
+	LogError(LogLevelInfo, "reload config applied: %v, need restart: %v", applied, restart)
+	return applied, restart, nil
+}
+
+// redisPoolReloadable check the redis nodes, addrs and weights not changed
+func redisPoolReloadable(o, n map[string]*RedisConfig) bool {
+	if len(o) != len(n) {
+		return false
+	}
+
+	for name, oc := range o {
+		nc, ok := n[name]
+		if !ok || oc.Network != nc.Network || oc.Addr != nc.Addr || oc.Weight != nc.Weight {
+			return false
+		}
+	}
+
+	return true
+}
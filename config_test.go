@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopush2.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	ConfFile = f.Name()
+	if err = ioutil.WriteFile(ConfFile, []byte(`{"tcp_addr":"127.0.0.1:8080", "heartbeat_sec":30}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(ConfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	SetConf(c)
+
+	if err = ioutil.WriteFile(ConfFile, []byte(`{"tcp_addr":"127.0.0.1:9090", "heartbeat_sec":60}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, restart, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 1 || applied[0] != "heartbeat_sec" || Conf().HeartbeatSec != 60 {
+		t.Errorf("heartbeat_sec must be applied, applied: %v", applied)
+	}
+
+	if len(restart) != 1 || restart[0] != "tcp_addr" || Conf().TCPAddr != "127.0.0.1:8080" {
+		t.Errorf("tcp_addr must need restart, restart: %v", restart)
+	}
+
+	// invalid config rejected
+	if err = ioutil.WriteFile(ConfFile, []byte(`{"heartbeat_sec":-1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = ReloadConfig(); err == nil {
+		t.Errorf("invalid config must be rejected")
+	}
+
+	if Conf().HeartbeatSec != 60 {
+		t.Errorf("heartbeat_sec must not be changed")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{
+		Node:              "gopush2-1",
+		TCPAddr:           "127.0.0.1:8080",
+		AdminAddr:         "127.0.0.1:8080",
+		ChannelBucket:     10,
+		ChannelType:       RedisChannelType,
+		ChannelExpireSec:  60,
+		ChannelSweepBatch: 100,
+		MessageExpireSec:  60,
+		MaxStoredMessage:  20,
+		HeartbeatSec:      30,
+		NodeHeartbeatSec:  10,
+		RedisCheckSec:     5,
+		ReadBufNumPerInst: 1,
+		ReadBufByte:       1,
+		WriteBufNum:       1,
+		WriteBufByte:      1,
+		WriteQueueSize:    64,
+		WriteTimeoutSec:   5,
+		Redis:             map[string]*RedisConfig{"redis-a": &RedisConfig{Network: "tcp", Addr: "127.0.0.1:6379"}},
+	}
+
+	err := c.Validate()
+	errs, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("config must be invalid")
+	}
+
+	// admin_addr, channel_bucket
+	if len(errs) != 2 {
+		t.Errorf("config must have 2 problems, but %d: %v", len(errs), errs)
+	}
+
+	c.AdminAddr = "127.0.0.1:8081"
+	c.ChannelBucket = 16
+	if err = c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if c.Redis["redis-a"].Weight != 1 {
+		t.Errorf("redis weight must be normalized")
+	}
+
+	if c.MaxProcs <= 0 || c.ReadBufInstance <= 0 {
+		t.Errorf("max_procs and read_buf_instance must be normalized")
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// write queue full policy
+	WriteQueueDropOldest = 0
+	WriteQueueDropNewest = 1
+	WriteQueueDisconnect = 2
+)
+
+var (
+	// all the subscriber conns of the node
+	subConns = NewConnList()
+	// conn number limiter of the node
+	connLimiter = NewConnLimiter()
+	// write buffer chan for frame the message
+	writeBuf chan *bytes.Buffer
+
+	// Frame format error
+	FrameFmtErr = errors.New("Frame format error")
+	// Exceed the max conn of the node
+	NodeMaxConnErr = errors.New("Exceed the max connection of the node")
+	// Exceed the max conn per remote ip
+	IPMaxConnErr = errors.New("Exceed the max connection per ip")
+	// Write queue full, slow subscriber disconnected
+	WriteQueueFullErr = errors.New("Write queue full")
+	// Conn writer closed
+	ConnWriterClosedErr = errors.New("Conn writer closed")
+)
+
+// ConnLimiter limit the conn number of the node and per remote ip
+type ConnLimiter struct {
+	mutex *sync.Mutex
+	total int
+	ips   map[string]int
+}
+
+// NewConnLimiter create a conn limiter
+func NewConnLimiter() *ConnLimiter {
+	return &ConnLimiter{mutex: &sync.Mutex{}, ips: map[string]int{}}
+}
+
+// Acquire count a accepted conn, exceed the Conf().MaxConn or
+// Conf().MaxConnPerIP will return errors, the caller must close the conn.
+// Succeed the caller must call Release when the conn closed.
+func (l *ConnLimiter) Acquire(addr net.Addr) error {
+	ip := remoteIP(addr)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if Conf().MaxConn > 0 && l.total+1 > Conf().MaxConn {
+		connStat.IncrNodeRejected()
+		return NodeMaxConnErr
+	}
+
+	if Conf().MaxConnPerIP > 0 && l.ips[ip]+1 > Conf().MaxConnPerIP {
+		connStat.IncrIPRejected()
+		return IPMaxConnErr
+	}
+
+	l.total++
+	l.ips[ip]++
+	return nil
+}
+
+// Release uncount a closed conn
+func (l *ConnLimiter) Release(addr net.Addr) {
+	ip := remoteIP(addr)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+}
+
+// Len get the conn number of the node
+func (l *ConnLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.total
+}
+
+// remoteIP get the ip of the remote addr
+func remoteIP(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return ip
+}
+
+// LimitListener limit the accepted conns by the connLimiter, the exceeded
+// conns will be closed at once.
+type LimitListener struct {
+	net.Listener
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = connLimiter.Acquire(c.RemoteAddr()); err != nil {
+			LogError(LogLevelWarn, "client:%s rejected (%s)", c.RemoteAddr().String(), err.Error())
+			if err = c.Close(); err != nil {
+				LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
+			}
+
+			continue
+		}
+
+		return &limitConn{Conn: c, once: &sync.Once{}}, nil
+	}
+}
+
+// limitConn release the connLimiter when closed
+type limitConn struct {
+	net.Conn
+	once *sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		connLimiter.Release(c.Conn.RemoteAddr())
+	})
+
+	return c.Conn.Close()
+}
+
+// InitWriteBuf init the write buffer chan, called at process start
+func InitWriteBuf() {
+	writeBuf = make(chan *bytes.Buffer, Conf().WriteBufNum)
+}
+
+// newWriteBuf get a buf from chan or create a new buf if chan is empty
+func newWriteBuf() *bytes.Buffer {
+	select {
+	case buf := <-writeBuf:
+		buf.Reset()
+		return buf
+	default:
+		return bytes.NewBuffer(make([]byte, 0, Conf().WriteBufByte))
+	}
+}
+
+// putWriteBuf put back the buf to the chan, if chan is full then discard it
+func putWriteBuf(buf *bytes.Buffer) {
+	select {
+	case writeBuf <- buf:
+	default:
+	}
+}
+
+// ConnWriter is the asynchronous writer of a subscriber conn, the frames
+// are queued and written by its own routine with a write deadline, so a slow
+// subscriber can't block the channel.
+type ConnWriter struct {
+	conn  net.Conn
+	queue chan *bytes.Buffer
+	done  chan bool
+	once  *sync.Once
+	// closed when the write routine exit
+	exit chan bool
+	// write timeout
+	timeout time.Duration
+}
+
+// NewConnWriter create a writer and start the write routine, the caller
+// must call Close when the conn handle routine exit.
+func NewConnWriter(conn net.Conn) *ConnWriter {
+	w := &ConnWriter{
+		conn:    conn,
+		queue:   make(chan *bytes.Buffer, Conf().WriteQueueSize),
+		done:    make(chan bool),
+		once:    &sync.Once{},
+		exit:    make(chan bool),
+		timeout: time.Duration(Conf().WriteTimeoutSec) * time.Second,
+	}
+
+	go w.writeLoop()
+	return w
+}
+
+// Write queue the frame, if the queue is full, handle by the
+// Conf().WriteQueuePolicy.
+func (w *ConnWriter) Write(buf *bytes.Buffer) error {
+	for {
+		select {
+		case <-w.done:
+			putWriteBuf(buf)
+			return ConnWriterClosedErr
+		case w.queue <- buf:
+			return nil
+		default:
+		}
+
+		// queue full
+		connStat.IncrQueueFull()
+		switch Conf().WriteQueuePolicy {
+		case WriteQueueDropOldest:
+			select {
+			case old := <-w.queue:
+				putWriteBuf(old)
+				connStat.IncrQueueDropped()
+				LogError(LogLevelWarn, "client:%s write queue full, drop the oldest frame", w.conn.RemoteAddr().String())
+			default:
+			}
+		case WriteQueueDropNewest:
+			putWriteBuf(buf)
+			connStat.IncrQueueDropped()
+			LogError(LogLevelWarn, "client:%s write queue full, drop the newest frame", w.conn.RemoteAddr().String())
+			return nil
+		default:
+			putWriteBuf(buf)
+			w.disconnect()
+			return WriteQueueFullErr
+		}
+	}
+}
+
+// WriteWait queue the frame, wait for the queue instead of the
+// Conf().WriteQueuePolicy if full, used by the offline messages replay which
+// may exceed the queue size. Disconnect the subscriber if still full after
+// the write timeout.
+func (w *ConnWriter) WriteWait(buf *bytes.Buffer) error {
+	t := time.NewTimer(w.timeout)
+	defer t.Stop()
+	select {
+	case <-w.done:
+		putWriteBuf(buf)
+		return ConnWriterClosedErr
+	case w.queue <- buf:
+		return nil
+	case <-t.C:
+		putWriteBuf(buf)
+		connStat.IncrQueueFull()
+		w.disconnect()
+		return WriteQueueFullErr
+	}
+}
+
+// disconnect close the slow subscriber
+func (w *ConnWriter) disconnect() {
+	connStat.IncrSlowDisconnected()
+	LogError(LogLevelWarn, "client:%s write queue full, disconnect", w.conn.RemoteAddr().String())
+	w.Close()
+	if err := w.conn.Close(); err != nil {
+		LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
+	}
+}
+
+// Close stop the write routine, the queued frames are discarded.
+func (w *ConnWriter) Close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// wait wait the write routine exit after closed
+func (w *ConnWriter) wait() {
+	<-w.exit
+}
+
+// writeLoop write the queued frames till closed, close the conn if write
+// failed or timedout, then the conn handle routine will exit.
+func (w *ConnWriter) writeLoop() {
+	defer close(w.exit)
+	for {
+		select {
+		case <-w.done:
+			return
+		case buf := <-w.queue:
+			err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+			if err == nil {
+				_, err = w.conn.Write(buf.Bytes())
+			}
+
+			putWriteBuf(buf)
+			if err != nil {
+				LogError(LogLevelErr, "client:%s conn.Write() failed (%s)", w.conn.RemoteAddr().String(), err.Error())
+				w.Close()
+				if err = w.conn.Close(); err != nil {
+					LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
+				}
+
+				return
+			}
+
+			// clear the deadline for the heartbeat written directly
+			if err = w.conn.SetWriteDeadline(time.Time{}); err != nil {
+				LogError(LogLevelErr, "conn.SetWriteDeadline() failed (%s)", err.Error())
+			}
+		}
+	}
+}
+
+// SubConn wrap the subscriber conn added to the channels, frame the message
+// json by the conn protocol, so one message can be pushed to the websocket
+// and tcp conns of the same channel. The frames are written by the
+// ConnWriter asynchronously, the heartbeat is written to the underlying conn
+// directly.
+type SubConn struct {
+	net.Conn
+	// asynchronous writer
+	w *ConnWriter
+	// conn protocol
+	proto int
+	// tag the frame with key for multiple keys subscription, empty if not
+	key string
+}
+
+// NewSubConn wrap the writer's conn by the protocol, key is empty for
+// single key subscription.
+func NewSubConn(w *ConnWriter, proto int, key string) *SubConn {
+	return &SubConn{Conn: w.conn, w: w, proto: proto, key: key}
+}
+
+// Write frame the message json and queue it to the writer.
+func (c *SubConn) Write(b []byte) (int, error) {
+	buf, err := c.frame(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = c.w.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteWait frame the message json and queue it to the writer, wait if the
+// queue full, see ConnWriter.WriteWait.
+func (c *SubConn) WriteWait(b []byte) (int, error) {
+	buf, err := c.frame(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = c.w.WriteWait(buf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Expire queue the expired frame of the key, the frame has no mid:
+// {"key":"key","expired":true}, framed by the conn protocol.
+func (c *SubConn) Expire(key string) error {
+	e := &expiredFrame{Expired: true}
+	// the tagged frame has the key already
+	if c.key == "" {
+		e.Key = key
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		LogError(LogLevelErr, "json.Marshal(\"%v\") failed (%s)", e, err.Error())
+		return err
+	}
+
+	_, err = c.Write(b)
+	return err
+}
+
+// shared check the socket shared by other keys, the tagged conns of the
+// multiple keys subscription and the tcp session conns.
+func (c *SubConn) shared() bool {
+	return c.key != "" || c.proto == TCPProtocol
+}
+
+// frame frame the message json by the conn protocol.
+// tcp: $size\r\njson\r\n
+// tcp with key: *2\r\n$keysize\r\nkey\r\n$size\r\njson\r\n
+// websocket: {"mid":1,"msg":"data"}
+// websocket with key: {"key":"key","mid":1,"msg":"data"}
+func (c *SubConn) frame(b []byte) (*bytes.Buffer, error) {
+	buf := newWriteBuf()
+	if c.proto == TCPProtocol {
+		if c.key != "" {
+			buf.WriteString("*2\r\n$")
+			buf.WriteString(strconv.Itoa(len(c.key)))
+			buf.WriteString("\r\n")
+			buf.WriteString(c.key)
+			buf.WriteString("\r\n")
+		}
+
+		buf.WriteString("$")
+		buf.WriteString(strconv.Itoa(len(b)))
+		buf.WriteString("\r\n")
+		buf.Write(b)
+		buf.WriteString("\r\n")
+	} else if c.key == "" {
+		buf.Write(b)
+	} else {
+		if len(b) < 2 || b[0] != '{' {
+			LogError(LogLevelErr, "device:%s frame \"%s\" not a json object", c.key, string(b))
+			putWriteBuf(buf)
+			return nil, FrameFmtErr
+		}
+
+		keyJson, err := json.Marshal(c.key)
+		if err != nil {
+			LogError(LogLevelErr, "json.Marshal(\"%s\") failed (%s)", c.key, err.Error())
+			putWriteBuf(buf)
+			return nil, err
+		}
+
+		buf.WriteString("{\"key\":")
+		buf.Write(keyJson)
+		if b[1] != '}' {
+			buf.WriteByte(',')
+		}
+
+		buf.Write(b[1:])
+	}
+
+	return buf, nil
+}
+
+// expiredFrame is the json of the expired frame
+type expiredFrame struct {
+	Key     string `json:"key,omitempty"`
+	Expired bool   `json:"expired"`
+}
+
+// ConnList store the subscriber conns of the node, used for shutdown
+type ConnList struct {
+	mutex *sync.Mutex
+	conns map[net.Conn]bool
+	wg    *sync.WaitGroup
+}
+
+// NewConnList create a empty conn list
+func NewConnList() *ConnList {
+	return &ConnList{
+		mutex: &sync.Mutex{},
+		conns: map[net.Conn]bool{},
+		wg:    &sync.WaitGroup{},
+	}
+}
+
+// Add add a conn to the list, the conn handle routine must call Remove when
+// exit.
+func (l *ConnList) Add(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conns[conn] = true
+	l.wg.Add(1)
+}
+
+// Remove remove the conn from the list
+func (l *ConnList) Remove(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.conns[conn]; ok {
+		delete(l.conns, conn)
+		l.wg.Done()
+	}
+}
+
+// Len get the conn number
+func (l *ConnList) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.conns)
+}
+
+// Range call f for every conn, f called out of the mutex.
+func (l *ConnList) Range(f func(conn net.Conn)) {
+	l.mutex.Lock()
+	conns := make([]net.Conn, 0, len(l.conns))
+	for conn, _ := range l.conns {
+		conns = append(conns, conn)
+	}
+
+	l.mutex.Unlock()
+	for _, conn := range conns {
+		f(conn)
+	}
+}
+
+// Wait wait all the conns removed, return false if timedout.
+func (l *ConnList) Wait(timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		l.wg.Wait()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
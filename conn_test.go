@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubConnWrite(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1})
+	InitWriteBuf()
+	msg := []byte(`{"mid":1,"msg":"test"}`)
+	tests := []struct {
+		proto int
+		key   string
+		frame string
+	}{
+		{TCPProtocol, "", "$22\r\n{\"mid\":1,\"msg\":\"test\"}\r\n"},
+		{TCPProtocol, "Terry-Mao", "*2\r\n$9\r\nTerry-Mao\r\n$22\r\n{\"mid\":1,\"msg\":\"test\"}\r\n"},
+		{WebsocketProtocol, "", `{"mid":1,"msg":"test"}`},
+		{WebsocketProtocol, "Terry-Mao", `{"key":"Terry-Mao","mid":1,"msg":"test"}`},
+	}
+
+	for _, test := range tests {
+		s, c := net.Pipe()
+		w := NewConnWriter(s)
+		if _, err := NewSubConn(w, test.proto, test.key).Write(msg); err != nil {
+			t.Error(err)
+		}
+
+		buf := make([]byte, 128)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf[:n]) != test.frame {
+			t.Errorf("frame must be %q, but %q", test.frame, string(buf[:n]))
+		}
+
+		w.Close()
+		c.Close()
+		w.wait()
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	SetConf(&Config{MaxConn: 3, MaxConnPerIP: 2})
+	l := NewConnLimiter()
+	a1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	a2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}
+	b1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+	if err := l.Acquire(a1); err != nil {
+		t.Error(err)
+	}
+
+	if err := l.Acquire(a2); err != nil {
+		t.Error(err)
+	}
+
+	if err := l.Acquire(a1); err != IPMaxConnErr {
+		t.Errorf("must exceed the max conn per ip")
+	}
+
+	if err := l.Acquire(b1); err != nil {
+		t.Error(err)
+	}
+
+	if err := l.Acquire(b1); err != NodeMaxConnErr {
+		t.Errorf("must exceed the max conn of node")
+	}
+
+	l.Release(a1)
+	if err := l.Acquire(a1); err != nil {
+		t.Error(err)
+	}
+
+	// no limit
+	SetConf(&Config{})
+	if err := l.Acquire(a1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnWriterQueueFull(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1, WriteQueuePolicy: WriteQueueDisconnect})
+	InitWriteBuf()
+	s, c := net.Pipe()
+	w := NewConnWriter(s)
+	sc := NewSubConn(w, WebsocketProtocol, "")
+	// the pipe blocked cause no reader, one frame in writing, one in queue
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = sc.Write([]byte(`{}`))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err != WriteQueueFullErr {
+		t.Errorf("slow conn must be disconnected, but (%v)", err)
+	}
+
+	w.Close()
+	c.Close()
+	w.wait()
+}
+
+func TestConnWriterWriteWait(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1, WriteQueuePolicy: WriteQueueDisconnect})
+	InitWriteBuf()
+	s, c := net.Pipe()
+	w := NewConnWriter(s)
+	sc := NewSubConn(w, WebsocketProtocol, "")
+	// the replay frames exceed the queue, wait for the reader
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			c.Read(make([]byte, 64))
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := sc.WriteWait([]byte(`{}`)); err != nil {
+			t.Errorf("replay frame %d must be queued, but (%v)", i, err)
+		}
+	}
+
+	w.Close()
+	c.Close()
+	w.wait()
+}
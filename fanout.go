@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// fanoutReplay buffer the live messages of a replaying conn
+type fanoutReplay struct {
+	msgs []*Message
+	// buffer full, replay again
+	overflow bool
+}
+
+// Fanout is the local conns of a key, shared by all the channel backends.
+// The live messages pushed while a conn replaying the offline messages are
+// buffered and sent after them, so a conn get the messages in order.
+type Fanout struct {
+	// Mutex
+	mutex *sync.Mutex
+	// Client conn
+	conn map[net.Conn]bool
+	// Replaying conns, the live messages buffered
+	replays map[net.Conn]*fanoutReplay
+	// Delivered message number of the node
+	delivered int64
+}
+
+// New a empty fanout
+func NewFanout() *Fanout {
+	return &Fanout{
+		mutex:   &sync.Mutex{},
+		conn:    map[net.Conn]bool{},
+		replays: map[net.Conn]*fanoutReplay{},
+	}
+}
+
+// Push send the message to all the conns, buffer it for the replaying conns
+func (f *Fanout) Push(m *Message, key string) {
+	// encode once for all the conns
+	if err := m.Encode(); err != nil {
+		LogError(LogLevelErr, "device:%s message.Encode() failed (%s)", key, err.Error())
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for conn, _ := range f.conn {
+		// replaying, send after the offline messages
+		if r, ok := f.replays[conn]; ok {
+			if len(r.msgs) < Conf().MaxStoredMessage {
+				r.msgs = append(r.msgs, m)
+			} else {
+				r.overflow = true
+			}
+
+			continue
+		}
+
+		f.write(conn, m, key)
+	}
+}
+
+// write send the message to the conn, the caller must hold the lock
+func (f *Fanout) write(conn net.Conn, m *Message, key string) error {
+	b, err := m.Bytes()
+	if err != nil {
+		LogError(LogLevelErr, "message.Bytes() failed (%s)", err.Error())
+		return err
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		LogError(LogLevelErr, "message write error, conn.Write() failed (%s)", err.Error())
+		return err
+	}
+
+	f.delivered++
+	LogError(LogLevelInfo, "push message \"%s\":%d to device:%s", m.Msg, m.MsgID, key)
+	return nil
+}
+
+// replayWriter is the conn waits for the write queue instead of dropping
+// the frames, the replay may exceed the queue size.
+type replayWriter interface {
+	WriteWait(b []byte) (int, error)
+}
+
+// Replay add the conn, send the offline messages ranged by the store, then
+// the live messages pushed meanwhile, all out of the lock. The conn removed
+// if failed.
+func (f *Fanout) Replay(conn net.Conn, mid int64, key string, store MessageStore) error {
+	f.mutex.Lock()
+	// check exceed the maxsubscribers, 0 means no limit
+	if Conf().MaxSubscriberPerKey > 0 && len(f.conn)+1 > Conf().MaxSubscriberPerKey {
+		f.mutex.Unlock()
+		return MaxConnErr
+	}
+
+	LogError(LogLevelInfo, "add conn for device:%s", key)
+	f.conn[conn] = true
+	f.replays[conn] = &fanoutReplay{}
+	f.mutex.Unlock()
+	for {
+		err := store.Range(mid, key, func(m *Message) error {
+			if err := f.replayWrite(conn, m); err != nil {
+				return err
+			}
+
+			chStat.IncrOfflineMsg()
+			mid = m.MsgID
+			return nil
+		})
+
+		overflow := false
+		if err == nil {
+			overflow, err = f.replayLive(conn, &mid, key)
+		}
+
+		if err != nil {
+			f.mutex.Lock()
+			f.remove(conn)
+			f.mutex.Unlock()
+			return err
+		}
+
+		if !overflow {
+			return nil
+		}
+	}
+}
+
+// replayLive send the buffered live messages newer than mid till none
+// buffered, then the conn get the live messages directly. Return true if
+// the buffer overflowed, the caller must replay again from the store.
+func (f *Fanout) replayLive(conn net.Conn, mid *int64, key string) (bool, error) {
+	for {
+		f.mutex.Lock()
+		r, ok := f.replays[conn]
+		if !ok {
+			// removed meanwhile
+			f.mutex.Unlock()
+			return false, nil
+		}
+
+		if r.overflow {
+			// too many live messages, replay again from the store
+			f.replays[conn] = &fanoutReplay{}
+			f.mutex.Unlock()
+			return true, nil
+		}
+
+		if len(r.msgs) == 0 {
+			delete(f.replays, conn)
+			f.mutex.Unlock()
+			return false, nil
+		}
+
+		msgs := r.msgs
+		r.msgs = nil
+		f.mutex.Unlock()
+		for _, m := range msgs {
+			if m.MsgID <= *mid {
+				continue
+			}
+
+			if err := f.replayWrite(conn, m); err != nil {
+				return false, err
+			}
+
+			*mid = m.MsgID
+			LogError(LogLevelInfo, "push message \"%s\":%d to device:%s", m.Msg, m.MsgID, key)
+		}
+	}
+}
+
+// replayWrite send the message to the replaying conn, wait for the write
+// queue if the conn supported
+func (f *Fanout) replayWrite(conn net.Conn, m *Message) error {
+	// the stored messages encoded once for all the replaying conns
+	if err := m.Encode(); err != nil {
+		LogError(LogLevelErr, "message.Encode() failed (%s)", err.Error())
+		return err
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		LogError(LogLevelErr, "message.Bytes() failed (%s)", err.Error())
+		return err
+	}
+
+	if w, ok := conn.(replayWriter); ok {
+		_, err = w.WriteWait(b)
+	} else {
+		_, err = conn.Write(b)
+	}
+
+	if err != nil {
+		LogError(LogLevelErr, "message write error, conn.Write() failed (%s)", err.Error())
+		return err
+	}
+
+	f.mutex.Lock()
+	f.delivered++
+	f.mutex.Unlock()
+	return nil
+}
+
+// Remove remove the conn
+func (f *Fanout) Remove(conn net.Conn, key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	LogError(LogLevelInfo, "remove conn for device:%s", key)
+	f.remove(conn)
+}
+
+// remove remove the conn, the caller must hold the lock
+func (f *Fanout) remove(conn net.Conn) {
+	delete(f.conn, conn)
+	delete(f.replays, conn)
+}
+
+// Delivered get the delivered message number of the node
+func (f *Fanout) Delivered() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.delivered
+}
+
+// Close remove all the conns of the expired or deleted key. The conns
+// sharing the socket with other keys get an expired frame, only the single key
+// websocket conns closed.
+func (f *Fanout) Close(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for conn, _ := range f.conn {
+		f.remove(conn)
+		if sc, ok := conn.(*SubConn); ok && sc.shared() {
+			if err := sc.Expire(key); err != nil {
+				LogError(LogLevelErr, "device:%s conn.Expire() failed (%s)", key, err.Error())
+			}
+
+			continue
+		}
+
+		if err := conn.Close(); err != nil {
+			// ignore close error
+			LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
+		}
+	}
+}
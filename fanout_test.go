@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fanoutTestConn record the written frames
+type fanoutTestConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	frames []string
+	// frames written by WriteWait
+	waits  int
+	closed bool
+}
+
+func (c *fanoutTestConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fanoutTestConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *fanoutTestConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.frames = append(c.frames, string(b))
+	return len(b), nil
+}
+
+func (c *fanoutTestConn) WriteWait(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.waits++
+	c.mutex.Unlock()
+	return c.Write(b)
+}
+
+// fanoutTestStore range the messages, push the live ones while ranging
+type fanoutTestStore struct {
+	*InnerStore
+	f    *Fanout
+	live []*Message
+}
+
+func (s *fanoutTestStore) Range(mid int64, key string, f func(m *Message) error) error {
+	for _, m := range s.live {
+		s.f.Push(m, key)
+	}
+
+	return s.InnerStore.Range(mid, key, f)
+}
+
+func TestFanoutReplay(t *testing.T) {
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60})
+	expire := time.Now().UnixNano() + 60*Second
+	s := &fanoutTestStore{InnerStore: NewInnerStore(), f: NewFanout()}
+	for i := 0; i < 2; i++ {
+		if err := s.Save(&Message{Msg: "offline", Expire: expire}, "Terry-Mao"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the live message 2 already replayed, skipped
+	s.live = []*Message{&Message{Msg: "offline", MsgID: 2}, &Message{Msg: "live", MsgID: 3}}
+	conn := &fanoutTestConn{}
+	if err := s.f.Replay(conn, 0, "Terry-Mao", s); err != nil {
+		t.Fatal(err)
+	}
+
+	live := &Message{Msg: "live", MsgID: 4}
+	s.f.Push(live, "Terry-Mao")
+	// encoded once for all the conns
+	if live.frame == nil {
+		t.Error("pushed message must be encoded")
+	}
+
+	frames := []string{`{"mid":1,"msg":"offline"}`, `{"mid":2,"msg":"offline"}`, `{"mid":3,"msg":"live"}`, `{"mid":4,"msg":"live"}`}
+	if len(conn.frames) != len(frames) {
+		t.Fatalf("frames must be %v, but %v", frames, conn.frames)
+	}
+
+	for i, f := range frames {
+		if conn.frames[i] != f {
+			t.Errorf("frame %d must be %s, but %s", i, f, conn.frames[i])
+		}
+	}
+
+	if d := s.f.Delivered(); d != 4 {
+		t.Errorf("delivered must be 4, but %d", d)
+	}
+
+	// the replayed frames wait for the write queue, the live one not
+	if conn.waits != 3 {
+		t.Errorf("replayed frames must be 3, but %d", conn.waits)
+	}
+}
+
+func TestFanoutClose(t *testing.T) {
+	SetConf(&Config{WriteQueueSize: 8, WriteTimeoutSec: 5})
+	f := NewFanout()
+	ws, tagged := &fanoutTestConn{}, &fanoutTestConn{}
+	ww, tw := NewConnWriter(ws), NewConnWriter(tagged)
+	defer func() {
+		for _, w := range []*ConnWriter{ww, tw} {
+			w.Close()
+			w.wait()
+		}
+	}()
+	s := NewInnerStore()
+	if err := f.Replay(NewSubConn(ww, WebsocketProtocol, ""), 0, "Terry-Mao", s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Replay(NewSubConn(tw, TCPProtocol, "Terry-Mao"), 0, "Terry-Mao", s); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close("Terry-Mao")
+	// the multiple keys conn not closed, get the expired frame
+	frame := "*2\r\n$9\r\nTerry-Mao\r\n$16\r\n{\"expired\":true}\r\n"
+	for i := 0; i < 100; i++ {
+		tagged.mutex.Lock()
+		n := len(tagged.frames)
+		tagged.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tagged.mutex.Lock()
+	defer tagged.mutex.Unlock()
+	if tagged.closed || len(tagged.frames) != 1 || tagged.frames[0] != frame {
+		t.Errorf("tagged conn must get the expired frame, but closed %t, %q", tagged.closed, tagged.frames)
+	}
+
+	if !ws.closed {
+		t.Error("single key websocket conn must be closed")
+	}
+
+	if len(f.conn) != 0 {
+		t.Errorf("conns must be removed, but %d", len(f.conn))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FileChannelType = 3
+	fileLogExt      = ".log"
+	fileLogTmpExt   = ".tmp"
+	// the log of the long key named by the sha1 of the key, the hex encoded
+	// name would exceed the file name limit
+	fileLogHashPre    = "sha1-"
+	fileLogMaxNameKey = 100
+	// compact the log if the records more than the live ones twice and
+	// this number
+	fileCompactMinRecords = 64
+)
+
+func init() {
+	RegisterChannelBackend(FileChannelType, &ChannelBackend{
+		Name: "file_channel",
+		Init: InitFileStore,
+		New: func(key string) (MessageStore, TokenStore, error) {
+			s, err := NewFileStore(key)
+			if err != nil {
+				LogError(LogLevelErr, "device:%s NewFileStore() failed (%s)", key, err.Error())
+				return nil, nil, err
+			}
+
+			return s, s, nil
+		},
+	})
+}
+
+// FileStore is a InnerStore persisted by a append-only log file per key, the
+// messages, acked message id and tokens are recovered from the log at
+// startup, the log compacted when purging the expired messages.
+type FileStore struct {
+	*InnerStore
+	// Append-only log
+	log *FileLog
+}
+
+// InitFileStore create the data directory and recover all the channels from
+// the log files
+func InitFileStore(l *ChannelList) error {
+	if err := os.MkdirAll(Conf().FileDir, 0755); err != nil {
+		LogError(LogLevelErr, "os.MkdirAll(\"%s\") failed (%s)", Conf().FileDir, err.Error())
+		return err
+	}
+
+	files, err := ioutil.ReadDir(Conf().FileDir)
+	if err != nil {
+		LogError(LogLevelErr, "ioutil.ReadDir(\"%s\") failed (%s)", Conf().FileDir, err.Error())
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, fileLogTmpExt) {
+			// crashed while compacting, the old log is still complete
+			os.Remove(filepath.Join(Conf().FileDir, name))
+			continue
+		}
+
+		if f.IsDir() || !strings.HasSuffix(name, fileLogExt) {
+			continue
+		}
+
+		stem := strings.TrimSuffix(name, fileLogExt)
+		k, err := hex.DecodeString(stem)
+		if err != nil && !strings.HasPrefix(stem, fileLogHashPre) {
+			LogError(LogLevelWarn, "unknown file:%s in \"%s\", ignored", name, Conf().FileDir)
+			continue
+		}
+
+		s, key, err := openFileStore(filepath.Join(Conf().FileDir, name))
+		if err != nil {
+			LogError(LogLevelErr, "file:%s recover channel failed (%s)", name, err.Error())
+			return err
+		}
+
+		// the logs written before the key record, named by the hex key
+		if key == "" {
+			if len(k) == 0 {
+				LogError(LogLevelWarn, "file:%s no key record, ignored", name)
+				s.log.Close()
+				continue
+			}
+
+			key = string(k)
+		}
+
+		s.mutex.Lock()
+		s.compact(key)
+		s.mutex.Unlock()
+		l.put(key, NewStoreChannel(key, s, s))
+		LogError(LogLevelInfo, "device:%s recover %d messages", key, s.message.Length)
+	}
+
+	return nil
+}
+
+// New a file message store, recover the stored messages if the log exists
+func NewFileStore(key string) (*FileStore, error) {
+	s, _, err := openFileStore(fileChannelPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// the key recovered from the log, the name may be hashed
+	if s.log.Records == 0 {
+		if err = s.log.Append(fileRecKey, []byte(key)); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+	}
+
+	s.compact(key)
+	return s, nil
+}
+
+// openFileStore open the log into a new store, return the key recorded in
+// the log, empty if not recorded
+func openFileStore(path string) (*FileStore, string, error) {
+	s := &FileStore{InnerStore: NewInnerStore()}
+	key := ""
+	log, err := OpenFileLog(path, Conf().FileSync == 1, func(typ byte, data []byte) error {
+		if typ == fileRecKey {
+			key = string(data)
+			return nil
+		}
+
+		return s.restore(typ, data)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.log = log
+	return s, key, nil
+}
+
+// fileChannelPath get the log file path of the key, the key hex encoded, or
+// the sha1 of the key hex encoded if the key too long
+func fileChannelPath(key string) string {
+	if len(key) > fileLogMaxNameKey {
+		sum := sha1.Sum([]byte(key))
+		return filepath.Join(Conf().FileDir, fileLogHashPre+hex.EncodeToString(sum[:])+fileLogExt)
+	}
+
+	return filepath.Join(Conf().FileDir, hex.EncodeToString([]byte(key))+fileLogExt)
+}
+
+// restore apply a log record
+func (s *FileStore) restore(typ byte, data []byte) error {
+	switch typ {
+	case fileRecMsg:
+		m := &Message{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return err
+		}
+
+		if m.MsgID > s.lastMsgID {
+			s.lastMsgID = m.MsgID
+		}
+
+		if m.Expired() {
+			return nil
+		}
+
+		if s.message.Length+1 > s.MaxMessage {
+			s.message.Delete(s.message.Head.Next().Score)
+		}
+
+		if err := m.Encode(); err != nil {
+			return err
+		}
+
+		// ignore the duplicated message
+		s.message.Insert(m.MsgID, m)
+	case fileRecAck, fileRecMsgID:
+		if len(data) != 8 {
+			return FileRecBrokenErr
+		}
+
+		mid := int64(binary.BigEndian.Uint64(data))
+		if typ == fileRecAck && mid > s.acked {
+			s.acked = mid
+		} else if typ == fileRecMsgID && mid > s.lastMsgID {
+			s.lastMsgID = mid
+		}
+	case fileRecAddToken:
+		s.token[string(data)] = true
+	case fileRecDelToken:
+		delete(s.token, string(data))
+	default:
+		return FileRecBrokenErr
+	}
+
+	return nil
+}
+
+// compact rewrite the log with the live records if too many dead ones, the
+// caller must hold the lock
+func (s *FileStore) compact(key string) {
+	live := s.message.Length + len(s.token) + 3
+	if s.log.Records < fileCompactMinRecords || s.log.Records < live*2 {
+		return
+	}
+
+	records := s.log.Records
+	err := s.log.Rewrite(func(w func(typ byte, data []byte) error) error {
+		if err := w(fileRecKey, []byte(key)); err != nil {
+			return err
+		}
+
+		if err := w(fileRecMsgID, int64Bytes(s.lastMsgID)); err != nil {
+			return err
+		}
+
+		if err := w(fileRecAck, int64Bytes(s.acked)); err != nil {
+			return err
+		}
+
+		for token, _ := range s.token {
+			if err := w(fileRecAddToken, []byte(token)); err != nil {
+				return err
+			}
+		}
+
+		for n := s.message.Head.Next(); n != nil; n = n.Next() {
+			b, err := json.Marshal(n.Member)
+			if err != nil {
+				return err
+			}
+
+			if err = w(fileRecMsg, b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		LogError(LogLevelErr, "device:%s compact log failed (%s)", key, err.Error())
+		return
+	}
+
+	LogError(LogLevelInfo, "device:%s compact log %d records to %d", key, records, s.log.Records)
+}
+
+// Save implements the MessageStore Save method.
+func (s *FileStore) Save(m *Message, key string) error {
+	// append to the log before stored
+	return s.save(m, key, func(m *Message) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			LogError(LogLevelErr, "json.Marshal() failed (%s)", err.Error())
+			return err
+		}
+
+		return s.log.Append(fileRecMsg, b)
+	})
+}
+
+// AddToken implements the TokenStore AddToken method.
+func (s *FileStore) AddToken(token string, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.token[token]; ok {
+		return TokenExistErr
+	}
+
+	if err := s.log.Append(fileRecAddToken, []byte(token)); err != nil {
+		return err
+	}
+
+	// token only used once
+	s.token[token] = true
+	return nil
+}
+
+// AuthToken implements the TokenStore AuthToken method.
+func (s *FileStore) AuthToken(token string, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.token[token]; !ok {
+		chStat.IncrAuthFailed()
+		return AuthTokenErr
+	}
+
+	if err := s.log.Append(fileRecDelToken, []byte(token)); err != nil {
+		return err
+	}
+
+	// token only used once
+	delete(s.token, token)
+	return nil
+}
+
+// Ack implements the MessageStore Ack method.
+func (s *FileStore) Ack(mid int64, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mid <= s.acked {
+		return nil
+	}
+
+	if err := s.log.Append(fileRecAck, int64Bytes(mid)); err != nil {
+		return err
+	}
+
+	s.acked = mid
+	return nil
+}
+
+// Purge implements the MessageStore Purge method.
+func (s *FileStore) Purge(key string) int {
+	purged := s.InnerStore.Purge(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compact(key)
+	return purged
+}
+
+// Close implements the MessageStore Close method, the channel expired, so the
+// log removed.
+func (s *FileStore) Close(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.log.Remove()
+}
+
+// int64Bytes encode the int64 big endian
+func int64Bytes(i int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60, FileDir: dir})
+	s, err := NewFileStore("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewStoreChannel("Terry-Mao", s, s)
+	expire := time.Now().UnixNano() + 60*Second
+	for i := 0; i < 3; i++ {
+		if err = c.PushMsg(&Message{Msg: "test", Expire: expire}, "Terry-Mao"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// expired message not recovered
+	if err = c.PushMsg(&Message{Msg: "test", Expire: time.Now().UnixNano() + 10*int64(time.Millisecond)}, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if err = c.Ack(2, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if err = c.AddToken("t1", "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	s.log.Close()
+	// simulate a crash while writing the last record
+	f, err := os.OpenFile(fileChannelPath("Terry-Mao"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte{0, 0, 0, 10, 1, 2})
+	f.Close()
+	time.Sleep(20 * time.Millisecond)
+	if s, err = NewFileStore("Terry-Mao"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.log.Close()
+	if s.message.Length != 3 {
+		t.Errorf("recovered messages must be 3, but %d", s.message.Length)
+	}
+
+	if s.lastMsgID != 4 {
+		t.Errorf("last message id must be 4, but %d", s.lastMsgID)
+	}
+
+	c = NewStoreChannel("Terry-Mao", s, s)
+	st, err := c.AckStat("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Acked != 2 || st.Unacked != 1 {
+		t.Errorf("acked must be 2 and unacked must be 1, but %d, %d", st.Acked, st.Unacked)
+	}
+
+	if err = c.AuthToken("t1", "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	// the broken tail truncated, can append again
+	m := &Message{Msg: "test", Expire: expire}
+	if err = c.PushMsg(m, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if m.MsgID != 5 {
+		t.Errorf("message id must be 5, but %d", m.MsgID)
+	}
+}
+
+func TestFileStoreMaxOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60, ChannelBucket: 16, ChannelType: FileChannelType, FileDir: dir, FileMaxOpen: 2})
+	// the long key named by the sha1
+	keys := []string{"Terry-Mao", "Terry", strings.Repeat("Terry-Mao", 100)}
+	stores := []*FileStore{}
+	for _, key := range keys {
+		s, err := NewFileStore(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = s.AddToken("t1", key); err != nil {
+			t.Error(err)
+		}
+
+		stores = append(stores, s)
+	}
+
+	// the closed logs reopened
+	for i, s := range stores {
+		if err = s.AddToken("t2", keys[i]); err != nil {
+			t.Error(err)
+		}
+
+		if n := fileLogs.Len(); n > 2 {
+			t.Errorf("open logs must not more than 2, but %d", n)
+		}
+	}
+
+	for _, s := range stores {
+		s.log.Close()
+	}
+
+	l := NewChannelList()
+	for _, key := range keys {
+		c, err := l.Get(key)
+		if err != nil {
+			t.Fatalf("key %s not recovered (%v)", key, err)
+		}
+
+		if err = c.AuthToken("t2", key); err != nil {
+			t.Error(err)
+		}
+	}
+
+	l.Range(func(key string, c Channel) {
+		c.Close()
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// record types
+	fileRecMsg      = byte(1)
+	fileRecAck      = byte(2)
+	fileRecMsgID    = byte(3)
+	fileRecAddToken = byte(4)
+	fileRecDelToken = byte(5)
+	fileRecKey      = byte(6)
+	// size + crc32
+	fileRecHeaderSize = 8
+	// a record can't be larger than this, or the file broken
+	fileRecMaxSize = 16 * 1024 * 1024
+)
+
+var (
+	// Record crc32 mismatch or size error
+	FileRecBrokenErr = errors.New("File log record broken")
+	// the open log files, the least recently used closed over
+	// Conf().FileMaxOpen
+	fileLogs = &fileLogLRU{mutex: &sync.Mutex{}, logs: list.New()}
+)
+
+// FileLog is a append-only log file, the record format:
+// | size uint32 | crc32 uint32 | type byte | data |
+// size is the length of type and data, crc32 is the IEEE checksum of type
+// and data, both big endian. The file closed if not recently used and
+// reopened on demand, so the open files limited by Conf().FileMaxOpen.
+type FileLog struct {
+	// guard the file, closed by the lru meanwhile
+	mutex *sync.Mutex
+	// nil if closed
+	file *os.File
+	// element in the lru, guard by the lru mutex
+	elem *list.Element
+	path string
+	// fsync after every append
+	sync bool
+	// end of the good records
+	offset int64
+	// record number, include the overwritten ones
+	Records int
+}
+
+// OpenFileLog open or create the log file, the records are passed to f in
+// order. A broken or partial record at the tail (crash while appending) is
+// truncated.
+func OpenFileLog(path string, fsync bool, f func(typ byte, data []byte) error) (*FileLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		LogError(LogLevelErr, "os.OpenFile(\"%s\") failed (%s)", path, err.Error())
+		return nil, err
+	}
+
+	l := &FileLog{mutex: &sync.Mutex{}, file: file, path: path, sync: fsync}
+	offset, err := l.replay(f)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// drop the broken tail
+	if err = file.Truncate(offset); err != nil {
+		LogError(LogLevelErr, "file.Truncate(\"%s\", %d) failed (%s)", path, offset, err.Error())
+		file.Close()
+		return nil, err
+	}
+
+	if _, err = file.Seek(offset, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l.offset = offset
+	fileLogs.touch(l)
+	return l, nil
+}
+
+// open reopen the file closed by the lru, the caller must hold the lock
+func (l *FileLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR, 0644)
+	if err != nil {
+		LogError(LogLevelErr, "os.OpenFile(\"%s\") failed (%s)", l.path, err.Error())
+		return err
+	}
+
+	if _, err = file.Seek(l.offset, 0); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	return nil
+}
+
+// closeFile close the file till used again
+func (l *FileLog) closeFile() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// replay read all the good records, return the offset of the end of them
+func (l *FileLog) replay(f func(typ byte, data []byte) error) (int64, error) {
+	rd := bufio.NewReader(l.file)
+	header := make([]byte, fileRecHeaderSize)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			if err != io.EOF {
+				LogError(LogLevelWarn, "file log:%s partial record header at %d, truncated", l.path, offset)
+			}
+
+			return offset, nil
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if size == 0 || size > fileRecMaxSize {
+			LogError(LogLevelWarn, "file log:%s record size %d error at %d, truncated", l.path, size, offset)
+			return offset, nil
+		}
+
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(rd, rec); err != nil {
+			LogError(LogLevelWarn, "file log:%s partial record at %d, truncated", l.path, offset)
+			return offset, nil
+		}
+
+		if crc32.ChecksumIEEE(rec) != sum {
+			LogError(LogLevelWarn, "file log:%s record crc32 mismatch at %d, truncated", l.path, offset)
+			return offset, nil
+		}
+
+		if err := f(rec[0], rec[1:]); err != nil {
+			LogError(LogLevelErr, "file log:%s replay record at %d failed (%s)", l.path, offset, err.Error())
+			return 0, err
+		}
+
+		l.Records++
+		offset += int64(fileRecHeaderSize + size)
+	}
+}
+
+// Append write a record
+func (l *FileLog) Append(typ byte, data []byte) error {
+	defer fileLogs.touch(l)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	if err := writeFileRec(l.file, typ, data); err != nil {
+		LogError(LogLevelErr, "file log:%s append failed (%s)", l.path, err.Error())
+		// drop the partial record, or the following records unreadable
+		if err := l.file.Truncate(l.offset); err == nil {
+			l.file.Seek(l.offset, 0)
+		}
+
+		return err
+	}
+
+	l.offset += int64(fileRecHeaderSize + 1 + len(data))
+	l.Records++
+	if l.sync {
+		if err := l.file.Sync(); err != nil {
+			LogError(LogLevelErr, "file log:%s sync failed (%s)", l.path, err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rewrite replace the log with the records written by f, the old log kept
+// if failed. The new log is written to a temporary file then renamed, so a
+// crash leaves either the old or the new one.
+func (l *FileLog) Rewrite(f func(w func(typ byte, data []byte) error) error) error {
+	defer fileLogs.touch(l)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		LogError(LogLevelErr, "os.OpenFile(\"%s\") failed (%s)", tmp, err.Error())
+		return err
+	}
+
+	records, offset := 0, int64(0)
+	bw := bufio.NewWriter(file)
+	err = f(func(typ byte, data []byte) error {
+		records++
+		offset += int64(fileRecHeaderSize + 1 + len(data))
+		return writeFileRec(bw, typ, data)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+
+	if err != nil {
+		LogError(LogLevelErr, "file log:%s rewrite failed (%s)", l.path, err.Error())
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file = file
+	l.offset = offset
+	l.Records = records
+	return nil
+}
+
+// Close close the log file
+func (l *FileLog) Close() error {
+	fileLogs.remove(l)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Remove close and delete the log file
+func (l *FileLog) Remove() error {
+	l.Close()
+	return os.Remove(l.path)
+}
+
+// fileLogLRU close the least recently used log files over
+// Conf().FileMaxOpen, 0 means no limit.
+type fileLogLRU struct {
+	mutex *sync.Mutex
+	logs  *list.List
+}
+
+// touch move the log to the front, close the logs over the limit. Called
+// without the log's lock, so two logs never wait for each other.
+func (u *fileLogLRU) touch(l *FileLog) {
+	u.mutex.Lock()
+	if l.elem != nil {
+		u.logs.MoveToFront(l.elem)
+	} else {
+		l.elem = u.logs.PushFront(l)
+	}
+
+	closed := []*FileLog{}
+	for max := Conf().FileMaxOpen; max > 0 && u.logs.Len() > max; {
+		e := u.logs.Back()
+		u.logs.Remove(e)
+		v := e.Value.(*FileLog)
+		v.elem = nil
+		closed = append(closed, v)
+	}
+
+	u.mutex.Unlock()
+	for _, v := range closed {
+		v.closeFile()
+	}
+}
+
+// remove remove the closed log
+func (u *fileLogLRU) remove(l *FileLog) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if l.elem != nil {
+		u.logs.Remove(l.elem)
+		l.elem = nil
+	}
+}
+
+// Len get the log number in the lru
+func (u *fileLogLRU) Len() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.logs.Len()
+}
+
+// writeFileRec write a record to w
+func writeFileRec(w io.Writer, typ byte, data []byte) error {
+	rec := make([]byte, fileRecHeaderSize+1+len(data))
+	rec[fileRecHeaderSize] = typ
+	copy(rec[fileRecHeaderSize+1:], data)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(1+len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[fileRecHeaderSize:]))
+	_, err := w.Write(rec)
+	return err
+}
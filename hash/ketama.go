@@ -4,6 +4,7 @@ import (
 	//	"crypto/md5"
 	"fmt"
 	"sort"
+	"sync"
 )
 
 // Convenience types for common cases
@@ -14,48 +15,143 @@ func (p UIntSlice) Len() int           { return len(p) }
 func (p UIntSlice) Less(i, j int) bool { return p[i] < p[j] }
 func (p UIntSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// Ketama is the consistent hashing ring, the nodes are named and weighted,
+// a node has vnode * weight virtual nodes. Adding or removing a node only
+// remaps the keys of it's virtual nodes. Safe for concurrent use.
 type Ketama struct {
-	node         int             // phsical node number
-	vnode        int             // virual node number
+	mutex        *sync.RWMutex
+	updateMutex  *sync.Mutex     // serialize the circle rebuilding
+	vnode        int             // virual node number per weight
+	weights      map[string]int  // phsical nodes and weights
 	nodes        []uint          // nodes
 	nodesMapping map[uint]string // nodes maping
 }
 
-// New create a ketama consistent hashing struct
+// New create a ketama consistent hashing struct, the nodes named
+// node1...nodeN
 func NewKetama(node, vnode int) *Ketama {
+	weights := map[string]int{}
+	for idx := 1; idx < node+1; idx++ {
+		weights[fmt.Sprintf("node%d", idx)] = 1
+	}
+
+	return NewKetamaNodes(weights, vnode)
+}
+
+// NewKetamaNodes create a ketama consistent hashing struct by the node names
+// and weights
+func NewKetamaNodes(weights map[string]int, vnode int) *Ketama {
 	ketama := &Ketama{}
-	ketama.node = node
+	ketama.mutex = &sync.RWMutex{}
+	ketama.updateMutex = &sync.Mutex{}
 	ketama.vnode = vnode
-	ketama.nodes = []uint{}
-	ketama.nodesMapping = map[uint]string{}
+	ketama.weights = map[string]int{}
+	for node, weight := range weights {
+		ketama.weights[node] = weight
+	}
 
-	ketama.initCircle()
+	ketama.nodes, ketama.nodesMapping = initCircle(ketama.weights, vnode)
 
 	return ketama
 }
 
-// init consistent hashing circle
-func (k *Ketama) initCircle() {
+// init consistent hashing circle of the weights
+func initCircle(weights map[string]int, vnode int) ([]uint, map[uint]string) {
+	nodes := []uint{}
+	nodesMapping := map[uint]string{}
 	h := NewMurmur3C()
-	for idx := 1; idx < k.node+1; idx++ {
-		node := fmt.Sprintf("node%d", idx)
-		for i := 0; i < k.vnode; i++ {
-			vnode := fmt.Sprintf("%s#%d", node, i)
-			h.Write([]byte(vnode))
+	for node, weight := range weights {
+		for i := 0; i < vnode*weight; i++ {
+			name := fmt.Sprintf("%s#%d", node, i)
+			h.Write([]byte(name))
 			vpos := uint(h.Sum32())
-			k.nodes = append(k.nodes, vpos)
-			k.nodesMapping[vpos] = node
 			h.Reset()
+			if n, ok := nodesMapping[vpos]; ok {
+				// hash collision, the smaller name wins in any order
+				if n > node {
+					nodesMapping[vpos] = node
+				}
+
+				continue
+			}
+
+			nodes = append(nodes, vpos)
+			nodesMapping[vpos] = node
 		}
 	}
 
-	sort.Sort(UIntSlice(k.nodes))
+	sort.Sort(UIntSlice(nodes))
+	return nodes, nodesMapping
+}
+
+// update change a copy of the weights by f, rebuild the circle out of the
+// lock, the readers use the old circle till the new one swapped in. f return
+// false if nothing changed.
+func (k *Ketama) update(f func(weights map[string]int) bool) {
+	k.updateMutex.Lock()
+	defer k.updateMutex.Unlock()
+	k.mutex.RLock()
+	weights := make(map[string]int, len(k.weights)+1)
+	for node, weight := range k.weights {
+		weights[node] = weight
+	}
+
+	k.mutex.RUnlock()
+	if !f(weights) {
+		return
+	}
+
+	nodes, nodesMapping := initCircle(weights, k.vnode)
+	k.mutex.Lock()
+	k.weights = weights
+	k.nodes = nodes
+	k.nodesMapping = nodesMapping
+	k.mutex.Unlock()
 }
 
-// Node get a consistent hashing node by key
+// AddNode add a node or change the weight of the node
+func (k *Ketama) AddNode(node string, weight int) {
+	k.update(func(weights map[string]int) bool {
+		weights[node] = weight
+		return true
+	})
+}
+
+// RemoveNode remove the node
+func (k *Ketama) RemoveNode(node string) {
+	k.update(func(weights map[string]int) bool {
+		if _, ok := weights[node]; !ok {
+			return false
+		}
+
+		delete(weights, node)
+		return true
+	})
+}
+
+// Nodes get all the node names
+func (k *Ketama) Nodes() []string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	nodes := make([]string, 0, len(k.weights))
+	for node, _ := range k.weights {
+		nodes = append(nodes, node)
+	}
+
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Node get a consistent hashing node by key, empty if no node
 func (k *Ketama) Node(key string) string {
 	h := NewMurmur3C()
 	h.Write([]byte(key))
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if len(k.nodes) == 0 {
+		return ""
+	}
+
 	idx := searchLeft(k.nodes, uint(h.Sum32()))
 	pos := k.nodes[0]
 	if idx != len(k.nodes) {
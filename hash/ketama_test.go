@@ -1,6 +1,8 @@
 package hash
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -31,3 +33,61 @@ func TestKetama(t *testing.T) {
 		t.Error("Terry-Mao5 must hit node13")
 	}
 }
+
+func TestKetamaAddRemoveNode(t *testing.T) {
+	k := NewKetamaNodes(map[string]int{"redis-a": 1, "redis-b": 1, "redis-c": 2}, 255)
+	keys := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("Terry-Mao%d", i)
+		keys[key] = k.Node(key)
+	}
+
+	// only the keys of the added node remapped
+	k.AddNode("redis-d", 1)
+	for key, node := range keys {
+		if n := k.Node(key); n != node && n != "redis-d" {
+			t.Errorf("%s must hit %s or redis-d, but %s", key, node, n)
+		}
+	}
+
+	// removed, all the keys back
+	k.RemoveNode("redis-d")
+	for key, node := range keys {
+		if n := k.Node(key); n != node {
+			t.Errorf("%s must hit %s, but %s", key, node, n)
+		}
+	}
+
+	k.RemoveNode("redis-a")
+	k.RemoveNode("redis-b")
+	k.RemoveNode("redis-c")
+	if n := k.Node("Terry-Mao"); n != "" {
+		t.Errorf("no node, but %s", n)
+	}
+}
+
+func TestKetamaConcurrentAddNode(t *testing.T) {
+	k := NewKetamaNodes(map[string]int{"redis-a": 1}, 255)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			k.AddNode(fmt.Sprintf("redis-%d", i), 1)
+		}(i)
+
+		// the readers use the old circle meanwhile
+		go func(i int) {
+			defer wg.Done()
+			if n := k.Node(fmt.Sprintf("Terry-Mao%d", i)); n == "" {
+				t.Error("node must not be empty")
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	// no update lost
+	if n := len(k.Nodes()); n != 9 {
+		t.Errorf("nodes must be 9, but %d", n)
+	}
+}
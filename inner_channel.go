@@ -2,195 +2,253 @@ package main
 
 import (
 	"github.com/Terry-Mao/gopush2/skiplist"
-	"net"
+	"os"
 	"sync"
-	"time"
 )
 
-type InnerChannel struct {
+const (
+	InnerChannelType = 1
+)
+
+func init() {
+	RegisterChannelBackend(InnerChannelType, &ChannelBackend{
+		Name: "inner_channel",
+		Init: InitInnerStore,
+		New: func(key string) (MessageStore, TokenStore, error) {
+			s := NewInnerStore()
+			return s, s, nil
+		},
+	})
+}
+
+// InnerStore is the message and token store of a key in memory
+type InnerStore struct {
 	// Mutex
 	mutex *sync.Mutex
-	// Client conn
-	conn map[net.Conn]bool
 	// Stored message
 	message *skiplist.SkipList
 	// Auth token
 	token map[string]bool
-	// Subscriber expired unixnano
-	expire int64
 	// Max message stored number
 	MaxMessage int
+	// Last message id, used for allocate message id
+	lastMsgID int64
+	// Last acked message id
+	acked int64
+}
+
+// InitInnerStore load the snapshot if configured
+func InitInnerStore(l *ChannelList) error {
+	if Conf().SnapshotFile == "" {
+		return nil
+	}
+
+	if err := LoadSnapshot(l, Conf().SnapshotFile); err != nil {
+		// keep the broken one for inspection, start with empty channels
+		LogError(LogLevelErr, "load snapshot \"%s\" failed (%s), moved to \"%s.broken\"", Conf().SnapshotFile, err.Error(), Conf().SnapshotFile)
+		os.Rename(Conf().SnapshotFile, Conf().SnapshotFile+".broken")
+	}
+
+	return nil
 }
 
-// New a inner message stored channel
-func NewInnerChannel() *InnerChannel {
-	c := &InnerChannel{}
-	c.mutex = &sync.Mutex{}
-	c.message = skiplist.New()
-	c.conn = map[net.Conn]bool{}
-	c.token = map[string]bool{}
-	c.MaxMessage = Conf.MaxStoredMessage
-	c.expire = time.Now().UnixNano() + Conf.ChannelExpireSec*Second
-
-	return c
+// New a inner message store
+func NewInnerStore() *InnerStore {
+	s := &InnerStore{}
+	s.mutex = &sync.Mutex{}
+	s.message = skiplist.New()
+	s.token = map[string]bool{}
+	s.MaxMessage = Conf().MaxStoredMessage
+
+	return s
 }
 
-// SendMsg implements the Channel SendMsg method.
-func (c *InnerChannel) SendMsg(conn net.Conn, mid int64, key string) error {
+// Range implements the MessageStore Range method. The messages are collected
+// in the lock and f called out of it, so a slow conn can't block the store.
+func (s *InnerStore) Range(mid int64, key string, f func(m *Message) error) error {
 	// WARN: inner store must lock
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	s.mutex.Lock()
+	// resume from the acked message
+	if s.acked > mid {
+		mid = s.acked
+	}
+
+	msgs := []*Message{}
 	// find the next node
-	for n := c.message.Greate(mid); n != nil; n = n.Next() {
+	for n := s.message.Greate(mid); n != nil; n = n.Next() {
 		m, ok := n.Member.(*Message)
 		if !ok {
 			// never happen
+			s.mutex.Unlock()
 			panic(AssertTypeErr)
 		}
 
 		// check message expired
 		if m.Expired() {
 			// WARN:though the node deleted, can access the next node
-			c.message.Delete(n.Score)
+			s.message.Delete(n.Score)
 			LogError(LogLevelWarn, "delete the expired message:%d for device:%s", n.Score, key)
 		} else {
-			b, err := m.Bytes(nil)
-			if err != nil {
-				LogError(LogLevelErr, "message.Bytes(nil) failed (%s)", err.Error())
-				return err
-			}
-
-			if _, err := conn.Write(b); err != nil {
-				return err
-			}
+			msgs = append(msgs, m)
+		}
+	}
+
+	s.mutex.Unlock()
+	for _, m := range msgs {
+		if err := f(m); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// PushMsg implements the Channel PushMsg method.
-func (c *InnerChannel) PushMsg(m *Message, key string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// Save implements the MessageStore Save method.
+func (s *InnerStore) Save(m *Message, key string) error {
+	return s.save(m, key, nil)
+}
+
+// save store the message, if persist not nil, it's called after the message
+// id allocated, the message dropped if persist failed.
+func (s *InnerStore) save(m *Message, key string, persist func(m *Message) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	// check message expired
 	if m.Expired() {
 		LogError(LogLevelWarn, "message:%d has already expired for device:%s", m.MsgID, key)
 		return MsgExpiredErr
 	}
 
+	// allocate or record the message id
+	lastMsgID := s.lastMsgID
+	if m.MsgID == AutoMsgID {
+		s.lastMsgID++
+		m.MsgID = s.lastMsgID
+	} else if m.MsgID > s.lastMsgID {
+		s.lastMsgID = m.MsgID
+	}
+
+	// encode before shared by the replaying conns
+	if err := m.Encode(); err != nil {
+		s.lastMsgID = lastMsgID
+		return err
+	}
+
+	if persist != nil {
+		if err := persist(m); err != nil {
+			s.lastMsgID = lastMsgID
+			return err
+		}
+	}
+
 	// check exceed the max message length
-	if c.message.Length+1 > c.MaxMessage {
+	if s.message.Length+1 > s.MaxMessage {
 		// remove the first node cause that's the smallest node
-		n := c.message.Head.Next()
+		n := s.message.Head.Next()
 		if n == nil {
 			// never happen
 			LogError(LogLevelWarn, "the subscriber touch a impossiable place")
 			panic("Skiplist head nil")
 		}
 
-		c.message.Delete(n.Score)
-		LogError(LogLevelErr, "message:%d exceed the max message (%d) setting, trim the subscriber for device:%s", n.Score, c.MaxMessage, key)
+		s.message.Delete(n.Score)
+		LogError(LogLevelErr, "message:%d exceed the max message (%d) setting, trim the subscriber for device:%s", n.Score, s.MaxMessage, key)
 	}
 
-	err := c.message.Insert(m.MsgID, m)
-	if err != nil {
+	if err := s.message.Insert(m.MsgID, m); err != nil {
 		return err
 	}
 
-	b, err := m.Bytes(nil)
-	if err != nil {
-		LogError(LogLevelErr, "message.Bytes(nil) failed (%s)", err.Error())
-		return err
-	}
-
-	// send message to all the clients
-	for conn, _ := range c.conn {
-		if _, err = conn.Write(b); err != nil {
-			LogError(LogLevelErr, "message write error, conn.Write() failed (%s)", err.Error())
-			continue
-		}
-
-		LogError(LogLevelInfo, "push message \"%s\":%d for device:%s", m.Msg, m.MsgID, key)
-	}
-
+	chStat.IncrMessage()
 	return nil
 }
 
-// AddConn implements the Channel AddConn method.
-func (c *InnerChannel) AddConn(conn net.Conn, mid int64, key string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	// check exceed the maxsubscribers
-	if len(c.conn)+1 > Conf.MaxSubscriberPerKey {
-		return MaxConnErr
+// AddToken implements the TokenStore AddToken method.
+func (s *InnerStore) AddToken(token string, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.token[token]; ok {
+		return TokenExistErr
 	}
 
-	LogError(LogLevelInfo, "add conn for device:%s", key)
-	c.conn[conn] = true
+	// token only used once
+	s.token[token] = true
 
 	return nil
 }
 
-// RemoveConn implements the Channel RemoveConn method.
-func (c *InnerChannel) RemoveConn(conn net.Conn, mid int64, key string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	LogError(LogLevelInfo, "remove conn for device:%s", key)
-	delete(c.conn, conn)
+// AuthToken implements the TokenStore AuthToken method.
+func (s *InnerStore) AuthToken(token string, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.token[token]; !ok {
+		chStat.IncrAuthFailed()
+		return AuthTokenErr
+	}
+
+	// token only used once
+	delete(s.token, token)
 
 	return nil
 }
 
-// AddToken implements the Channel AddToken method.
-func (c *InnerChannel) AddToken(token string, key string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if _, ok := c.token[token]; ok {
-		return TokenExistErr
+// Purge implements the MessageStore Purge method.
+func (s *InnerStore) Purge(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	purged := 0
+	for n := s.message.Head.Next(); n != nil; n = n.Next() {
+		m, ok := n.Member.(*Message)
+		if !ok {
+			// never happen
+			panic(AssertTypeErr)
+		}
+
+		if m.Expired() {
+			// WARN:though the node deleted, can access the next node
+			s.message.Delete(n.Score)
+			purged++
+		}
 	}
 
-	// token only used once
-	c.token[token] = true
+	if purged > 0 {
+		LogError(LogLevelInfo, "purge %d expired messages for device:%s", purged, key)
+	}
 
-	return nil
+	return purged
 }
 
-// AuthToken implements the Channel AuthToken method.
-func (c *InnerChannel) AuthToken(token string, key string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if _, ok := c.token[token]; !ok {
-		return AuthTokenErr
+// Ack implements the MessageStore Ack method.
+func (s *InnerStore) Ack(mid int64, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mid > s.acked {
+		s.acked = mid
 	}
 
-	// token only used once
-	delete(c.token, token)
-
 	return nil
 }
 
-// SetDeadline implements the Channel SetDeadline method.
-func (c *InnerChannel) SetDeadline(d int64) {
-	c.expire = d
-}
+// AckStat implements the MessageStore AckStat method.
+func (s *InnerStore) AckStat(key string) (*AckStat, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := &AckStat{Acked: s.acked}
+	for n := s.message.Greate(s.acked); n != nil; n = n.Next() {
+		st.Unacked++
+	}
 
-// Timeout implements the Channel Timeout method.
-func (c *InnerChannel) Timeout() bool {
-	return time.Now().UnixNano() > c.expire
+	return st, nil
 }
 
-// Close implements the Channel Close method.
-func (c *InnerChannel) Close() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	for conn, _ := range c.conn {
-		if err := conn.Close(); err != nil {
-			// ignore close error
-			LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
-		}
-	}
+// SetMaxMessage set the max message stored number
+func (s *InnerStore) SetMaxMessage(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.MaxMessage = n
+}
 
+// Close implements the MessageStore Close method.
+func (s *InnerStore) Close(key string) error {
 	return nil
 }
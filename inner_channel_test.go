@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInnerChannelAutoMsgID(t *testing.T) {
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60})
+	s := NewInnerStore()
+	c := NewStoreChannel("Terry-Mao", s, s)
+	expire := time.Now().UnixNano() + 60*Second
+	m := &Message{Msg: "test1", Expire: expire}
+	if err := c.PushMsg(m, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if m.MsgID != 1 {
+		t.Errorf("message id must be 1, but %d", m.MsgID)
+	}
+
+	// caller supplied message id
+	if err := c.PushMsg(&Message{Msg: "test10", Expire: expire, MsgID: 10}, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	m = &Message{Msg: "test11", Expire: expire}
+	if err := c.PushMsg(m, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if m.MsgID != 11 {
+		t.Errorf("message id must be 11, but %d", m.MsgID)
+	}
+}
+
+func TestInnerChannelAck(t *testing.T) {
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60})
+	s := NewInnerStore()
+	c := NewStoreChannel("Terry-Mao", s, s)
+	expire := time.Now().UnixNano() + 60*Second
+	for i := 0; i < 3; i++ {
+		if err := c.PushMsg(&Message{Msg: "test", Expire: expire}, "Terry-Mao"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := c.Ack(2, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	// ack never go back
+	if err := c.Ack(1, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	st, err := c.AckStat("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Acked != 2 || st.Unacked != 1 {
+		t.Errorf("acked must be 2 and unacked must be 1, but %d, %d", st.Acked, st.Unacked)
+	}
+}
+
+func TestInnerStoreRangeUnlocked(t *testing.T) {
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60})
+	s := NewInnerStore()
+	expire := time.Now().UnixNano() + 60*Second
+	if err := s.Save(&Message{Msg: "test", Expire: expire}, "Terry-Mao"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow conn writing in f can't block the store
+	err := s.Range(0, "Terry-Mao", func(m *Message) error {
+		if err := s.Ack(m.MsgID, "Terry-Mao"); err != nil {
+			return err
+		}
+
+		return s.Save(&Message{Msg: "test", Expire: expire}, "Terry-Mao")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.message.Length != 2 || s.acked != 1 {
+		t.Errorf("messages must be 2 and acked must be 1, but %d, %d", s.message.Length, s.acked)
+	}
+}
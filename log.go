@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"sync/atomic"
 )
 
 const (
@@ -17,7 +18,7 @@ const (
 var (
 	logi            *log.Logger
 	logFile         *os.File
-	defaultLogLevel = LogLevelErr
+	defaultLogLevel = int32(LogLevelErr)
 	errLevels       = []string{"error", "warn", "info", "debug"}
 )
 
@@ -28,12 +29,12 @@ func init() {
 func NewLog() error {
 	var err error
 
-	defaultLogLevel = Conf.LogLevel
+	SetLogLevel(Conf().LogLevel)
 	// init log
-	if Conf.Log != "" {
-		logFile, err = os.OpenFile(Conf.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if Conf().Log != "" {
+		logFile, err = os.OpenFile(Conf().Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			logi.Printf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644) failed (%s)", Conf.Log, err.Error())
+			logi.Printf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644) failed (%s)", Conf().Log, err.Error())
 			return err
 		}
 
@@ -49,8 +50,13 @@ func CloseLog() {
 	}
 }
 
+// SetLogLevel set the log level, can be called at runtime
+func SetLogLevel(level int) {
+	atomic.StoreInt32(&defaultLogLevel, int32(level))
+}
+
 func LogError(level int, format string, args ...interface{}) {
-	if defaultLogLevel >= level {
+	if int(atomic.LoadInt32(&defaultLogLevel)) >= level {
 		logCore(level, format, args...)
 	}
 }
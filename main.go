@@ -8,20 +8,32 @@ import (
 )
 
 func main() {
-	var err error
 	defer recoverFunc()
 
 	// parse cmd-line arguments
 	flag.Parse()
 	// init config
-	Conf, err = NewConfig(ConfFile)
+	c, err := NewConfig(ConfFile)
 	if err != nil {
 		LogError(LogLevelErr, "NewConfig(\"%s\") failed (%s)", ConfFile, err.Error())
 		os.Exit(-1)
 	}
 
+	// validate config, print every problem
+	if err = c.Validate(); err != nil {
+		if errs, ok := err.(ConfigError); ok {
+			for _, e := range errs {
+				LogError(LogLevelErr, "config error: %s", e)
+			}
+		}
+
+		LogError(LogLevelErr, "Validate() failed, %s is invalid", ConfFile)
+		os.Exit(-1)
+	}
+
+	SetConf(c)
 	// Set max routine
-	runtime.GOMAXPROCS(Conf.MaxProcs)
+	runtime.GOMAXPROCS(Conf().MaxProcs)
 	// init log
 	if err = NewLog(); err != nil {
 		LogError(LogLevelErr, "NewLog() failed (%s)", err.Error())
@@ -36,13 +48,16 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// start channel sweeper
+	channel.StartSweeper()
+	// start inner channel snapshot
+	StartSnapshot()
+	// announce this node
+	StartNodeRegistry()
+	// init write buffer
+	InitWriteBuf()
 	// start stats
 	StartStats()
-	if Conf.Addr == Conf.AdminAddr {
-		LogError(LogLevelWarn, "\"AdminAdd = Addr\" is not allowed for security reason")
-		os.Exit(-1)
-	}
-
 	// start admin http
 	go func() {
 		if err := StartAdminHttp(); err != nil {
@@ -51,21 +66,28 @@ func main() {
 		}
 	}()
 
-	if Conf.Protocol == WebsocketProtocol {
-		// Start http push service
-		if err = StartHttp(); err != nil {
-			LogError(LogLevelErr, "StartHttp() failed (%s)", err.Error())
-		}
-	} else if Conf.Protocol == TCPProtocol {
+	if Conf().WebsocketAddr != "" {
 		// Start http push service
-		if err = StartTCP(); err != nil {
-			LogError(LogLevelErr, "StartTCP() failed (%s)", err.Error())
-		}
-	} else {
-		LogError(LogLevelWarn, "not support gopush2 protocol %d, (0: websocket, 1: tcp)", Conf.Protocol)
-		os.Exit(-1)
+		go func() {
+			if err := StartHttp(); err != nil {
+				LogError(LogLevelErr, "StartHttp() failed (%s)", err.Error())
+				os.Exit(-1)
+			}
+		}()
+	}
+
+	if Conf().TCPAddr != "" {
+		// Start tcp push service
+		go func() {
+			if err := StartTCP(); err != nil {
+				LogError(LogLevelErr, "StartTCP() failed (%s)", err.Error())
+				os.Exit(-1)
+			}
+		}()
 	}
 
+	// block until a shutdown signal
+	HandleSignal(InitSignal())
 	LogError(LogLevelInfo, "gopush2 stop")
 }
 
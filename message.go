@@ -1,17 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"strconv"
 	"time"
 )
 
+const (
+	// Message id allocated by the channel
+	AutoMsgID = int64(0)
+)
+
 var (
 	// Message expired
 	MsgExpiredErr = errors.New("Message already expired")
-	MsgBufErr     = errors.New("Message writeu buffer nil")
+	// Message id must greate than 0
+	MsgIDErr = errors.New("Message id error")
 )
 
 // The Message struct
@@ -22,6 +27,10 @@ type Message struct {
 	Expire int64 `json:"expire"`
 	// Message id
 	MsgID int64 `json:"mid"`
+	// Encoded json cache
+	frame []byte
+	// Encoded msg json, shared by the copies pushed to many keys
+	body []byte
 }
 
 // Expired check mesage expired or not
@@ -40,41 +49,67 @@ func NewJsonStrMessage(str string) (*Message, error) {
 	return m, nil
 }
 
-func (m *Message) Bytes(b *bytes.Buffer) ([]byte, error) {
-	res := map[string]interface{}{
-		"msg": m.Msg,
-		"mid": m.MsgID,
+// Encode encode the message and cache the json, the message pushed to many
+// keys or conns only encode once, Bytes return the cached json after that.
+// Must be called before the message shared by the goroutines, no-op if
+// encoded.
+func (m *Message) Encode() error {
+	if m.frame != nil {
+		return nil
 	}
 
-	byteJson, err := json.Marshal(res)
+	b, err := m.Bytes()
 	if err != nil {
-		LogError(LogLevelErr, "message write error, json.Marshal() failed (%s)", err.Error())
-		return nil, err
+		return err
 	}
 
-	if Conf.Protocol == TCPProtocol {
-		if b == nil {
-			return nil, MsgBufErr
-		}
+	m.frame = b
+	return nil
+}
 
-		// $size\r\ndata\r\n
-		if _, err = b.WriteString(fmt.Sprintf("$%d\r\n", len(byteJson))); err != nil {
-			LogError(LogLevelErr, "message write error, b.WriteString() failed (%s)", err.Error())
-			return nil, err
-		}
+// Bytes get the message json, the conn frame it by the protocol. The msg
+// json spliced with the message id if encoded by EncodeBody.
+func (m *Message) Bytes() ([]byte, error) {
+	if m.frame != nil {
+		return m.frame, nil
+	}
 
-		if _, err = b.Write(byteJson); err != nil {
-			LogError(LogLevelErr, "message write error, b.WriteString() failed (%s)", err.Error())
+	body := m.body
+	if body == nil {
+		b, err := json.Marshal(m.Msg)
+		if err != nil {
+			LogError(LogLevelErr, "message write error, json.Marshal() failed (%s)", err.Error())
 			return nil, err
 		}
 
-		if _, err = b.WriteString("\r\n"); err != nil {
-			LogError(LogLevelErr, "message write error, b.WriteString() failed (%s)", err.Error())
-			return nil, err
-		}
+		body = b
+	}
+
+	// same as the json of {"mid":mid,"msg":msg}
+	mid := strconv.FormatInt(m.MsgID, 10)
+	b := make([]byte, 0, len(`{"mid":,"msg":}`)+len(mid)+len(body))
+	b = append(b, `{"mid":`...)
+	b = append(b, mid...)
+	b = append(b, `,"msg":`...)
+	b = append(b, body...)
+	b = append(b, '}')
+	return b, nil
+}
 
-		return b.Bytes(), nil
-	} else {
-		return byteJson, nil
+// EncodeBody encode the msg json once, the copies of the message share it,
+// only the message id spliced per copy.
+func (m *Message) EncodeBody() error {
+	b, err := json.Marshal(m.Msg)
+	if err != nil {
+		LogError(LogLevelErr, "json.Marshal() failed (%s)", err.Error())
+		return err
 	}
+
+	m.body = b
+	return nil
+}
+
+// Copy copy the message without the message id, share the encoded msg json.
+func (m *Message) Copy() *Message {
+	return &Message{Msg: m.Msg, Expire: m.Expire, body: m.body}
 }
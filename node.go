@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Terry-Mao/gopush2/hash"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	nodeRedisPre  = "n_"
+	nodesRedisKey = "nodes"
+	nodeVNode     = 255
+	nodeTTLTimes  = 3
+)
+
+var (
+	// No live node
+	NoNodeErr = errors.New("No live gopush2 node")
+	// the live nodes of the cluster
+	nodes = NewNodeRegistry()
+)
+
+// NodeInfo is the announced info of a gopush2 node.
+type NodeInfo struct {
+	// Node name
+	Node string `json:"node"`
+	// Subscriber addresses, empty if the protocol disabled
+	TCPAddr       string `json:"tcp_addr"`
+	WebsocketAddr string `json:"websocket_addr"`
+	// Publisher address
+	AdminAddr string `json:"admin_addr"`
+	// Subscriber conn number
+	Conn int `json:"conn"`
+	// Announced unixnano
+	Updated int64 `json:"updated"`
+}
+
+// NodeRegistry announce this node into redis with a ttl every
+// Conf().NodeHeartbeatSec, and load the live nodes for routing the keys. If
+// not the redis channel, only this node.
+type NodeRegistry struct {
+	// Mutex
+	mutex *sync.RWMutex
+	// Live nodes sorted by name
+	nodes []*NodeInfo
+	// Live nodes by name
+	names map[string]*NodeInfo
+	// Consistent hashing ring of the live nodes
+	ring *hash.Ketama
+}
+
+// NewNodeRegistry create a empty node registry
+func NewNodeRegistry() *NodeRegistry {
+	return &NodeRegistry{
+		mutex: &sync.RWMutex{},
+		names: map[string]*NodeInfo{},
+		ring:  hash.NewKetamaNodes(nil, nodeVNode),
+	}
+}
+
+// StartNodeRegistry announce this node and start the heartbeat goroutine
+func StartNodeRegistry() {
+	nodes.update([]*NodeInfo{selfNodeInfo()})
+	if Conf().ChannelType != RedisChannelType {
+		return
+	}
+
+	nodes.heartbeat()
+	go func() {
+		for !isShutdown() {
+			time.Sleep(time.Duration(Conf().NodeHeartbeatSec) * time.Second)
+			if !isShutdown() {
+				nodes.heartbeat()
+			}
+		}
+	}()
+}
+
+// selfNodeInfo get this node's info
+func selfNodeInfo() *NodeInfo {
+	return &NodeInfo{
+		Node:          Conf().Node,
+		TCPAddr:       Conf().TCPAddr,
+		WebsocketAddr: Conf().WebsocketAddr,
+		AdminAddr:     Conf().AdminAddr,
+		Conn:          subConns.Len(),
+		Updated:       time.Now().UnixNano(),
+	}
+}
+
+// heartbeat announce this node then load the live nodes
+func (r *NodeRegistry) heartbeat() {
+	if err := r.register(); err != nil {
+		LogError(LogLevelErr, "node:%s register failed (%s)", Conf().Node, err.Error())
+		return
+	}
+
+	live, err := r.load()
+	if err != nil {
+		LogError(LogLevelErr, "load live nodes failed (%s)", err.Error())
+		return
+	}
+
+	r.update(live)
+}
+
+// register store this node's info with a ttl (SET EX, SADD)
+func (r *NodeRegistry) register() error {
+	b, err := json.Marshal(selfNodeInfo())
+	if err != nil {
+		return err
+	}
+
+	rc := getRedisConn(nodesRedisKey)
+	if rc == nil {
+		return RedisNoConnErr
+	}
+
+	defer rc.Close()
+	ttl := Conf().NodeHeartbeatSec * nodeTTLTimes
+	if _, err = rc.Do("SET", nodeRedisPre+Conf().Node, b, "EX", ttl); err != nil {
+		LogError(LogLevelErr, "redis(\"SET\", \"%s\", \"EX\", %d) failed (%s)", nodeRedisPre+Conf().Node, ttl, err.Error())
+		return err
+	}
+
+	if _, err = rc.Do("SADD", nodesRedisKey, Conf().Node); err != nil {
+		LogError(LogLevelErr, "redis(\"SADD\", \"%s\", \"%s\") failed (%s)", nodesRedisKey, Conf().Node, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Unregister remove this node from redis when shutdown (DEL, SREM)
+func (r *NodeRegistry) Unregister() {
+	if Conf().ChannelType != RedisChannelType {
+		return
+	}
+
+	rc := getRedisConn(nodesRedisKey)
+	if rc == nil {
+		LogError(LogLevelWarn, "can't get a redis connection")
+		return
+	}
+
+	defer rc.Close()
+	if _, err := rc.Do("DEL", nodeRedisPre+Conf().Node); err != nil {
+		LogError(LogLevelErr, "redis(\"DEL\", \"%s\") failed (%s)", nodeRedisPre+Conf().Node, err.Error())
+	}
+
+	if _, err := rc.Do("SREM", nodesRedisKey, Conf().Node); err != nil {
+		LogError(LogLevelErr, "redis(\"SREM\", \"%s\", \"%s\") failed (%s)", nodesRedisKey, Conf().Node, err.Error())
+	}
+}
+
+// load get the live nodes, the expired nodes removed from the set
+// (SMEMBERS, MGET, SREM)
+func (r *NodeRegistry) load() ([]*NodeInfo, error) {
+	rc := getRedisConn(nodesRedisKey)
+	if rc == nil {
+		return nil, RedisNoConnErr
+	}
+
+	defer rc.Close()
+	names, err := redis.Strings(rc.Do("SMEMBERS", nodesRedisKey))
+	if err != nil {
+		LogError(LogLevelErr, "redis(\"SMEMBERS\", \"%s\") failed (%s)", nodesRedisKey, err.Error())
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, NoNodeErr
+	}
+
+	args := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		args = append(args, nodeRedisPre+name)
+	}
+
+	infos, err := redis.Strings(rc.Do("MGET", args...))
+	if err != nil {
+		LogError(LogLevelErr, "redis(\"MGET\") failed (%s)", err.Error())
+		return nil, err
+	}
+
+	live := make([]*NodeInfo, 0, len(names))
+	for i, info := range infos {
+		if info == "" {
+			// node heartbeat timedout
+			LogError(LogLevelWarn, "node:%s expired, remove it", names[i])
+			if _, err = rc.Do("SREM", nodesRedisKey, names[i]); err != nil {
+				LogError(LogLevelErr, "redis(\"SREM\", \"%s\", \"%s\") failed (%s)", nodesRedisKey, names[i], err.Error())
+			}
+
+			continue
+		}
+
+		n := &NodeInfo{}
+		if err = json.Unmarshal([]byte(info), n); err != nil {
+			LogError(LogLevelErr, "node:%s json.Unmarshal(\"%s\") failed (%s)", names[i], info, err.Error())
+			continue
+		}
+
+		live = append(live, n)
+	}
+
+	if len(live) == 0 {
+		return nil, NoNodeErr
+	}
+
+	return live, nil
+}
+
+// update replace the live nodes, add the new nodes to and remove the dead
+// nodes from the ring, so only their keys remapped
+func (r *NodeRegistry) update(live []*NodeInfo) {
+	sort.Sort(nodeInfoSlice(live))
+	names := make(map[string]*NodeInfo, len(live))
+	for _, n := range live {
+		names[n.Node] = n
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, _ := range r.names {
+		if _, ok := names[name]; !ok {
+			LogError(LogLevelInfo, "node:%s removed from the ring", name)
+			r.ring.RemoveNode(name)
+		}
+	}
+
+	for name, _ := range names {
+		if _, ok := r.names[name]; !ok {
+			LogError(LogLevelInfo, "node:%s added to the ring", name)
+			r.ring.AddNode(name, 1)
+		}
+	}
+
+	r.nodes = live
+	r.names = names
+}
+
+// Node get the node of the key by the ketama ring
+func (r *NodeRegistry) Node(key string) (*NodeInfo, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	n, ok := r.names[r.ring.Node(key)]
+	if !ok {
+		return nil, NoNodeErr
+	}
+
+	return n, nil
+}
+
+// Nodes get the live nodes
+func (r *NodeRegistry) Nodes() []*NodeInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.nodes
+}
+
+// NodeHandle is the web api for get the node of the key, subscribers connect
+// to and publishers push to it. If no key, return all the live nodes.
+func NodeHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		if err := retDataWrite(w, "ok", retOK, nodes.Nodes()); err != nil {
+			LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	n, err := nodes.Node(key)
+	if err != nil {
+		if err = retWrite(w, "can't get a node", retGetNode); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	if err = retDataWrite(w, "ok", retOK, n); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+	}
+}
+
+type nodeInfoSlice []*NodeInfo
+
+func (p nodeInfoSlice) Len() int           { return len(p) }
+func (p nodeInfoSlice) Less(i, j int) bool { return p[i].Node < p[j].Node }
+func (p nodeInfoSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNodeRegistry(t *testing.T) {
+	r := NewNodeRegistry()
+	if _, err := r.Node("Terry-Mao"); err != NoNodeErr {
+		t.Errorf("err must be NoNodeErr, but %v", err)
+	}
+
+	r.update([]*NodeInfo{&NodeInfo{Node: "gopush2-3"}, &NodeInfo{Node: "gopush2-1"}, &NodeInfo{Node: "gopush2-2"}})
+	n, err := r.Node("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same nodes in any order, same node of the key
+	r.update([]*NodeInfo{&NodeInfo{Node: "gopush2-2"}, &NodeInfo{Node: "gopush2-1"}, &NodeInfo{Node: "gopush2-3"}})
+	if n1, err := r.Node("Terry-Mao"); err != nil || n1.Node != n.Node {
+		t.Errorf("node must be %s, but %v (%v)", n.Node, n1, err)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -27,12 +30,19 @@ const (
 	retAddToken = 4
 	// message push failed
 	retPushMsg = 5
+	// reload config failed
+	retReloadConfig = 6
+	// get ack stat failed
+	retAckStat = 7
+	// get node failed
+	retGetNode = 8
 )
 
 const (
 	WebsocketProtocol = 0
 	TCPProtocol       = 1
 	heartbeatMsg      = "h"
+	ackCmd            = "ack"
 	oneSecond         = int64(time.Second)
 )
 
@@ -45,6 +55,12 @@ var (
 	AuthTokenErr = errors.New("Auth token failed")
 	// Token exists
 	TokenExistErr = errors.New("Token already exist")
+	// Ack command argument error
+	AckArgErr = errors.New("Ack argument error")
+	// Exceed the max subscribed keys per conn
+	MaxSubKeyErr = errors.New("Exceed the max subscribed keys per connection")
+	// Subscribe the same key twice in one conn
+	SubKeyExistErr = errors.New("Subscribed key already exist")
 
 	// heartbeat bytes
 	heartbeatBytes = []byte(heartbeatMsg)
@@ -56,10 +72,18 @@ func StartAdminHttp() error {
 	adminServeMux := http.NewServeMux()
 	// publish
 	adminServeMux.HandleFunc("/pub", PublishHandle)
+	adminServeMux.HandleFunc("/pubs", BatchPublishHandle)
+	adminServeMux.HandleFunc("/broadcast", BroadcastHandle)
 	// stat
 	adminServeMux.HandleFunc("/stat", StatHandle)
+	// reload config
+	adminServeMux.HandleFunc("/reload", ReloadHandle)
+	// ack stat
+	adminServeMux.HandleFunc("/ack", AckHandle)
+	// node of the key
+	adminServeMux.HandleFunc("/node", NodeHandle)
 	// channel
-	if Conf.Auth == 1 {
+	if Conf().Auth == AuthStored {
 		adminServeMux.HandleFunc("/ch", ChannelHandle)
 	}
 
@@ -67,9 +91,19 @@ func StartAdminHttp() error {
 	adminServeMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	adminServeMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	adminServeMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	err := http.ListenAndServe(Conf.AdminAddr, adminServeMux)
+	l, err := net.Listen("tcp", Conf().AdminAddr)
 	if err != nil {
-		LogError(LogLevelErr, "http.ListenAdServe(\"%s\") failed (%s)", Conf.AdminAddr, err.Error())
+		LogError(LogLevelErr, "net.Listen(\"tcp\", \"%s\") failed (%s)", Conf().AdminAddr, err.Error())
+		return err
+	}
+
+	addListener(l)
+	if err = http.Serve(l, adminServeMux); err != nil {
+		if isShutdown() {
+			return nil
+		}
+
+		LogError(LogLevelErr, "http.Serve(\"%s\") failed (%s)", Conf().AdminAddr, err.Error())
 		return err
 	}
 
@@ -109,8 +143,9 @@ func ChannelHandle(w http.ResponseWriter, r *http.Request) {
 		LogError(LogLevelWarn, "device:%s can't add token %s", key, token)
 		if err = retWrite(w, "add token failed", retAddToken); err != nil {
 			LogError(LogLevelErr, "retWrite failed (%s)", err.Error())
-			return
 		}
+
+		return
 	}
 
 	if err = retWrite(w, "ok", retOK); err != nil {
@@ -120,6 +155,69 @@ func ChannelHandle(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// ReloadHandle is the web api for reload the config file
+func ReloadHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+
+	applied, restart, err := ReloadConfig()
+	if err != nil {
+		if err = retWrite(w, "reload config failed", retReloadConfig); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	res := map[string]interface{}{"applied": applied, "restart": restart}
+	if err = retDataWrite(w, "ok", retOK, res); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+	}
+}
+
+// AckHandle is the web api for get the acked message id, delivered and
+// unacked message number of the subscriber
+func AckHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		if err := retWrite(w, "param error", retParamErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	c, err := channel.Get(key)
+	if err != nil {
+		if err = retWrite(w, "can't get a subscriber", retGetChannel); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	s, err := c.AckStat(key)
+	if err != nil {
+		LogError(LogLevelErr, "device:%s get ack stat failed (%s)", key, err.Error())
+		if err = retWrite(w, "get ack stat failed", retAckStat); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	if err = retDataWrite(w, "ok", retOK, s); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+	}
+}
+
 // PublishHandle is the web api for the publish message
 func PublishHandle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -130,18 +228,10 @@ func PublishHandle(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	// get pub message key
 	key := params.Get("key")
-	// get the expired sec
-	expireStr := params.Get("expire")
-	expire, err := strconv.ParseInt(expireStr, 10, 64)
-	if err != nil {
-		// use default setting
-		expire = Conf.MessageExpireSec * Second
-	}
-
-	expire = time.Now().UnixNano() + expire*Second
-	// get message id
-	midStr := params.Get("mid")
-	mid, err := strconv.ParseInt(midStr, 10, 64)
+	// get the expired unixnano
+	expire := pubExpire(params)
+	// get message id, empty for allocated by the channel
+	mid, err := pubMsgID(params)
 	if err != nil {
 		if err = retWrite(w, "param error", retParamErr); err != nil {
 			LogError(LogLevelErr, "retWrite failed (%s)", err.Error())
@@ -160,7 +250,7 @@ func PublishHandle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// fetch subscriber from the channel
-	c, err := channel.Get(key)
+	c, err := pubChannel(key)
 	if err != nil {
 		if err = retWrite(w, "can't get a subscriber", retGetChannel); err != nil {
 			LogError(LogLevelErr, "pubRetWrite() failed (%s)", err.Error())
@@ -169,7 +259,8 @@ func PublishHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = c.PushMsg(&Message{Msg: string(body), Expire: expire, MsgID: mid}, key); err != nil {
+	m := &Message{Msg: string(body), Expire: expire, MsgID: mid}
+	if err = c.PushMsg(m, key); err != nil {
 		LogError(LogLevelWarn, "device:%s push message failed (%s)", key, err.Error())
 		if err = retWrite(w, "push msg failed", retPushMsg); err != nil {
 			LogError(LogLevelErr, "pubRetWrite() failed (%s)", err.Error())
@@ -177,12 +268,206 @@ func PublishHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = retWrite(w, "ok", retOK); err != nil {
-		LogError(LogLevelErr, "pubRetWrite() failed (%s)", err.Error())
+	if err = retDataWrite(w, "ok", retOK, map[string]interface{}{"mid": m.MsgID}); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
 		return
 	}
 }
 
+// BatchPublishHandle is the web api for publish one message to many keys,
+// the body is a json object: {"keys":["key1", "key2"], "msg":"message"}.
+func BatchPublishHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+
+	params := r.URL.Query()
+	// get the expired unixnano
+	expire := pubExpire(params)
+	// get message id, empty for allocated by the channel
+	mid, err := pubMsgID(params)
+	if err != nil {
+		if err = retWrite(w, "param error", retParamErr); err != nil {
+			LogError(LogLevelErr, "retWrite failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if err = retWrite(w, "read http body error", retInternalErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	req := &batchPubReq{}
+	if err = json.Unmarshal(body, req); err != nil || len(req.Keys) == 0 {
+		if err = retWrite(w, "param error", retParamErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	m, err := newPubMsg(req.Msg, expire, mid)
+	if err != nil {
+		if err = retWrite(w, "encode msg failed", retInternalErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	res := map[string]*pubRet{}
+	for _, key := range req.Keys {
+		c, err := pubChannel(key)
+		if err != nil {
+			res[key] = &pubRet{Ret: retGetChannel}
+			continue
+		}
+
+		res[key] = pushMsg(c, m, key)
+	}
+
+	if err = retDataWrite(w, "ok", retOK, res); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+	}
+}
+
+// BroadcastHandle is the web api for publish one message to all the keys
+func BroadcastHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+
+	params := r.URL.Query()
+	// get the expired unixnano
+	expire := pubExpire(params)
+	// get message id, empty for allocated by the channel
+	mid, err := pubMsgID(params)
+	if err != nil {
+		if err = retWrite(w, "param error", retParamErr); err != nil {
+			LogError(LogLevelErr, "retWrite failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if err = retWrite(w, "read http body error", retInternalErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	m, err := newPubMsg(string(body), expire, mid)
+	if err != nil {
+		if err = retWrite(w, "encode msg failed", retInternalErr); err != nil {
+			LogError(LogLevelErr, "retWrite() failed (%s)", err.Error())
+		}
+
+		return
+	}
+
+	res := map[string]*pubRet{}
+	channel.Range(func(key string, c Channel) {
+		res[key] = pushMsg(c, m, key)
+	})
+
+	if mid == AutoMsgID {
+		LogError(LogLevelInfo, "broadcast message (auto id) to %d devices", len(res))
+	} else {
+		LogError(LogLevelInfo, "broadcast message:%d to %d devices", mid, len(res))
+	}
+
+	if err = retDataWrite(w, "ok", retOK, res); err != nil {
+		LogError(LogLevelErr, "retDataWrite() failed (%s)", err.Error())
+	}
+}
+
+// batchPubReq is the batch publish request body
+type batchPubReq struct {
+	Keys []string `json:"keys"`
+	Msg  string   `json:"msg"`
+}
+
+// pubRet is the publish result of one key
+type pubRet struct {
+	Ret int   `json:"ret"`
+	Mid int64 `json:"mid,omitempty"`
+}
+
+// newPubMsg create a message pushed to many keys. If the message id set,
+// encode once for all the keys, else encode the msg once and every key copy
+// the message cause the channel allocate the id for each key.
+func newPubMsg(msg string, expire, mid int64) (*Message, error) {
+	m := &Message{Msg: msg, Expire: expire, MsgID: mid}
+	if err := m.EncodeBody(); err != nil {
+		return nil, err
+	}
+
+	if mid != AutoMsgID {
+		if err := m.Encode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// pushMsg push the message to the channel, return the publish result
+func pushMsg(c Channel, m *Message, key string) *pubRet {
+	if m.MsgID == AutoMsgID {
+		// copy for allocate the message id
+		m = m.Copy()
+	}
+
+	if err := c.PushMsg(m, key); err != nil {
+		LogError(LogLevelWarn, "device:%s push message failed (%s)", key, err.Error())
+		return &pubRet{Ret: retPushMsg}
+	}
+
+	return &pubRet{Ret: retOK, Mid: m.MsgID}
+}
+
+// pubMsgID get the message id param, if not set or 0, return AutoMsgID
+func pubMsgID(params url.Values) (int64, error) {
+	midStr := params.Get("mid")
+	if midStr == "" {
+		return AutoMsgID, nil
+	}
+
+	mid, err := strconv.ParseInt(midStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if mid < AutoMsgID {
+		return 0, MsgIDErr
+	}
+
+	return mid, nil
+}
+
+// pubExpire get the message expired unixnano from the expire second param,
+// if not set use the default setting.
+func pubExpire(params url.Values) int64 {
+	expire, err := strconv.ParseInt(params.Get("expire"), 10, 64)
+	if err != nil {
+		// use default setting
+		expire = Conf().MessageExpireSec
+	}
+
+	return time.Now().UnixNano() + expire*Second
+}
+
 func retWrite(w http.ResponseWriter, msg string, ret int) error {
 	res := map[string]interface{}{}
 	res["msg"] = msg
@@ -203,3 +488,192 @@ func retWrite(w http.ResponseWriter, msg string, ret int) error {
 
 	return nil
 }
+
+// retDataWrite write the ret code with the result data
+func retDataWrite(w http.ResponseWriter, msg string, ret int, data interface{}) error {
+	res := map[string]interface{}{}
+	res["msg"] = msg
+	res["ret"] = ret
+	res["data"] = data
+
+	strJson, err := json.Marshal(res)
+	if err != nil {
+		LogError(LogLevelErr, "json.Marshal(\"%v\") failed", res)
+		return err
+	}
+
+	if _, err := w.Write(strJson); err != nil {
+		LogError(LogLevelErr, "w.Write(\"%s\") failed (%s)", string(strJson), err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// subKey is one key of the multiple keys subscription
+type subKey struct {
+	key   string
+	mid   int64
+	token string
+	// already authed, skip the token auth
+	authed bool
+	c      Channel
+	conn   *SubConn
+}
+
+// subKeysString join the subscribed keys for log
+func subKeysString(keys []*subKey) string {
+	strs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		strs = append(strs, k.key)
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// subChannel fetch the subscriber's channel, create a new one if auth off
+func subChannel(key string) (Channel, error) {
+	c, err := channel.Get(key)
+	if err != nil {
+		// the stored token added by /ch with the channel
+		if Conf().Auth != AuthStored {
+			c, err = channel.New(key)
+			if err != nil {
+				LogError(LogLevelErr, "device:%s can't create channle (%s)", key, err.Error())
+				return nil, err
+			}
+		} else {
+			LogError(LogLevelWarn, "device:%s can't get a channel (%s)", key, err.Error())
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// pubChannel fetch the channel for publishing. The redis channel publish the
+// message to all the nodes subscribed the key, so needn't a local channel.
+func pubChannel(key string) (Channel, error) {
+	c, err := channel.Get(key)
+	if err != nil && Conf().ChannelType == RedisChannelType {
+		return redisPubChannel, nil
+	}
+
+	return c, err
+}
+
+// subscribeKeys auth all the keys, then send offline messages and add the
+// conn to every key's channel, if tag the frames tagged with the key. If any
+// key failed, the added keys will be removed, so caller needn't call
+// unsubscribeKeys.
+func subscribeKeys(w *ConnWriter, proto int, keys []*subKey, tag bool) error {
+	var err error
+
+	if Conf().MaxSubKeyPerConn > 0 && len(keys) > Conf().MaxSubKeyPerConn {
+		return MaxSubKeyErr
+	}
+
+	exists := map[string]bool{}
+	for _, k := range keys {
+		if _, ok := exists[k.key]; ok {
+			return SubKeyExistErr
+		}
+
+		exists[k.key] = true
+		if k.c, err = subAuthChannel(k.key, k.token, k.authed); err != nil {
+			return err
+		}
+	}
+
+	// send first heartbeat to tell client service is ready for accept heartbeat
+	if _, err = w.conn.Write(heartbeatBytes); err != nil {
+		LogError(LogLevelErr, "device:%s write first heartbeat to client failed (%s)", subKeysString(keys), err.Error())
+		return err
+	}
+
+	for i, k := range keys {
+		if tag {
+			k.conn = NewSubConn(w, proto, k.key)
+		} else {
+			k.conn = NewSubConn(w, proto, "")
+		}
+
+		// send stored message, and use the last message id if sent any
+		if err = k.c.SendMsg(k.conn, k.mid, k.key); err != nil {
+			LogError(LogLevelErr, "device:%s send offline message failed (%s)", k.key, err.Error())
+			unsubscribeKeys(keys[:i])
+			return err
+		}
+
+		// add a conn to the channel
+		if err = k.c.AddConn(k.conn, k.mid, k.key); err != nil {
+			LogError(LogLevelErr, "device:%s add conn failed (%s)", k.key, err.Error())
+			unsubscribeKeys(keys[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unsubscribeKeys remove the conn from every key's channel
+func unsubscribeKeys(keys []*subKey) {
+	for _, k := range keys {
+		if err := k.c.RemoveConn(k.conn, k.mid, k.key); err != nil {
+			LogError(LogLevelErr, "device:%s remove conn failed (%s)", k.key, err.Error())
+		}
+	}
+}
+
+// ackFunc handle the client ack command arguments
+type ackFunc func(args []string) error
+
+// singleAck handle the ack command of single key subscription, args: mid
+func singleAck(c Channel, key string) ackFunc {
+	return func(args []string) error {
+		if len(args) != 1 {
+			LogError(LogLevelWarn, "device:%s ack argument number error", key)
+			return AckArgErr
+		}
+
+		return ackMsg(c, args[0], key)
+	}
+}
+
+// multiAck handle the ack command of multiple keys subscription,
+// args: key, mid
+func multiAck(keys []*subKey) ackFunc {
+	return func(args []string) error {
+		if len(args) != 2 {
+			LogError(LogLevelWarn, "device:%s ack argument number error", subKeysString(keys))
+			return AckArgErr
+		}
+
+		for _, k := range keys {
+			if k.key == args[0] {
+				return ackMsg(k.c, args[1], k.key)
+			}
+		}
+
+		LogError(LogLevelWarn, "device:%s ack not subscribed key", args[0])
+		return AckArgErr
+	}
+}
+
+// ackMsg advance the acked message id of the channel, storage error is
+// ignored cause the client can ack again.
+func ackMsg(c Channel, midStr string, key string) error {
+	mid, err := strconv.ParseInt(midStr, 10, 64)
+	if err != nil {
+		LogError(LogLevelErr, "device:%s ack mid:\"%s\" argument error (%s)", key, midStr, err.Error())
+		return AckArgErr
+	}
+
+	if err = c.Ack(mid, key); err != nil {
+		LogError(LogLevelErr, "device:%s ack message:%d failed (%s)", key, mid, err.Error())
+		return nil
+	}
+
+	LogError(LogLevelInfo, "device:%s ack message:%d", key, mid)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -36,24 +37,32 @@ func (l *KeepAliveListener) Accept() (c net.Conn, err error) {
 func StartHttp() error {
 	// set sub handler
 	http.Handle("/sub", websocket.Handler(SubscribeHandle))
-	if Conf.Debug == 1 {
+	http.Handle("/msub", websocket.Handler(MultiSubscribeHandle))
+	if Conf().Debug == 1 {
 		http.HandleFunc("/client", Client)
 	}
 
-	if Conf.TCPKeepAlive == 1 {
-		server := &http.Server{}
-		l, err := net.Listen("tcp", Conf.Addr)
-		if err != nil {
-			LogError(LogLevelErr, "net.Listen(\"tcp\", \"%s\") failed (%s)", Conf.Addr, err.Error())
-			return err
-		}
+	l, err := net.Listen("tcp", Conf().WebsocketAddr)
+	if err != nil {
+		LogError(LogLevelErr, "net.Listen(\"tcp\", \"%s\") failed (%s)", Conf().WebsocketAddr, err.Error())
+		return err
+	}
 
-		return server.Serve(&KeepAliveListener{Listener: l})
-	} else {
-		if err := http.ListenAndServe(Conf.Addr, nil); err != nil {
-			LogError(LogLevelErr, "http.ListenAdServe(\"%s\") failed (%s)", Conf.Addr, err.Error())
-			return err
+	addListener(l)
+	if Conf().TCPKeepAlive == 1 {
+		l = &KeepAliveListener{Listener: l}
+	}
+
+	// limit the conn number
+	l = &LimitListener{Listener: l}
+
+	if err = http.Serve(l, nil); err != nil {
+		if isShutdown() {
+			return nil
 		}
+
+		LogError(LogLevelErr, "http.Serve(\"%s\") failed (%s)", Conf().WebsocketAddr, err.Error())
+		return err
 	}
 
 	// nerve here
@@ -62,6 +71,8 @@ func StartHttp() error {
 
 // Subscriber Handle is the websocket handle for sub request
 func SubscribeHandle(ws *websocket.Conn) {
+	subConns.Add(ws)
+	defer subConns.Remove(ws)
 	params := ws.Request().URL.Query()
 	// get subscriber key
 	key := params.Get("key")
@@ -74,7 +85,7 @@ func SubscribeHandle(ws *websocket.Conn) {
 	}
 
 	// get heartbeat second
-	heartbeat := Conf.HeartbeatSec
+	heartbeat := Conf().HeartbeatSec
 	heartbeatStr := params.Get("heartbeat")
 	if heartbeatStr != "" {
 		i, err := strconv.Atoi(heartbeatStr)
@@ -95,27 +106,10 @@ func SubscribeHandle(ws *websocket.Conn) {
 	// get auth token
 	token := params.Get("token")
 	LogError(LogLevelInfo, "client:%s subscribe to key = %s, mid = %d, token = %s, heartbeat = %d", ws.Request().RemoteAddr, key, mid, token, heartbeat)
-	// fetch subscriber from the channel
-	c, err := channel.Get(key)
+	// auth and fetch subscriber from the channel
+	c, err := subAuthChannel(key, token, false)
 	if err != nil {
-		if Conf.Auth == 0 {
-			c, err = channel.New(key)
-			if err != nil {
-				LogError(LogLevelErr, "device:%s can't create channle (%s)", key, err.Error())
-				return
-			}
-		} else {
-			LogError(LogLevelErr, "device:%s can't get a channel (%s)", key, err.Error())
-			return
-		}
-	}
-
-	// auth
-	if Conf.Auth == 1 {
-		if err = c.AuthToken(token, key); err != nil {
-			LogError(LogLevelErr, "device:%s auth token failed \"%s\" (%s)", key, token, err.Error())
-			return
-		}
+		return
 	}
 
 	// send first heartbeat to tell client service is ready for accept heartbeat
@@ -124,19 +118,104 @@ func SubscribeHandle(ws *websocket.Conn) {
 		return
 	}
 
+	// frame the message by protocol, write asynchronously
+	w := NewConnWriter(ws)
+	defer w.Close()
+	sc := NewSubConn(w, WebsocketProtocol, "")
 	// send stored message, and use the last message id if sent any
-	if err = c.SendMsg(ws, mid, key); err != nil {
+	if err = c.SendMsg(sc, mid, key); err != nil {
 		LogError(LogLevelErr, "device:%s send offline message failed (%s)", key, err.Error())
 		return
 	}
 
 	// add a conn to the channel
-	if err = c.AddConn(ws, mid, key); err != nil {
+	if err = c.AddConn(sc, mid, key); err != nil {
 		LogError(LogLevelErr, "device:%s add conn failed (%s)", key, err.Error())
 		return
 	}
 
 	// blocking wait client heartbeat
+	waitHeartbeat(ws, key, heartbeat, singleAck(c, key))
+	// remove exists conn
+	if err := c.RemoveConn(sc, mid, key); err != nil {
+		LogError(LogLevelErr, "device:%s remove conn failed (%s)", key, err.Error())
+	}
+
+	return
+}
+
+// MultiSubscribeHandle is the websocket handle for multiple keys sub request,
+// the key, mid, token arguments are repeated and matched by the order.
+// e.g. /msub?key=a&mid=0&token=t1&key=b&mid=10&token=t2&heartbeat=30
+func MultiSubscribeHandle(ws *websocket.Conn) {
+	subConns.Add(ws)
+	defer subConns.Remove(ws)
+	params := ws.Request().URL.Query()
+	keyStrs := params["key"]
+	midStrs := params["mid"]
+	tokens := params["token"]
+	if len(keyStrs) == 0 || len(keyStrs) != len(midStrs) {
+		LogError(LogLevelErr, "key and mid argument number error")
+		return
+	}
+
+	keys := make([]*subKey, 0, len(keyStrs))
+	for i, key := range keyStrs {
+		mid, err := strconv.ParseInt(midStrs[i], 10, 64)
+		if err != nil {
+			LogError(LogLevelErr, "mid argument error (%s)", err.Error())
+			return
+		}
+
+		token := ""
+		if i < len(tokens) {
+			token = tokens[i]
+		}
+
+		keys = append(keys, &subKey{key: key, mid: mid, token: token})
+	}
+
+	// get heartbeat second
+	heartbeat := Conf().HeartbeatSec
+	heartbeatStr := params.Get("heartbeat")
+	if heartbeatStr != "" {
+		i, err := strconv.Atoi(heartbeatStr)
+		if err != nil {
+			LogError(LogLevelErr, "heartbeat argument error (%s)", err.Error())
+			return
+		}
+
+		heartbeat = i
+	}
+
+	heartbeat *= 2
+	if heartbeat <= 0 {
+		LogError(LogLevelErr, "heartbeat argument error, less than 0")
+		return
+	}
+
+	LogError(LogLevelInfo, "client:%s subscribe to keys = %s, heartbeat = %d", ws.Request().RemoteAddr, subKeysString(keys), heartbeat)
+	w := NewConnWriter(ws)
+	defer w.Close()
+	if err := subscribeKeys(w, WebsocketProtocol, keys, true); err != nil {
+		LogError(LogLevelErr, "client:%s subscribe keys failed (%s)", ws.Request().RemoteAddr, err.Error())
+		return
+	}
+
+	// blocking wait client heartbeat
+	waitHeartbeat(ws, subKeysString(keys), heartbeat, multiAck(keys))
+	// remove exists conns
+	unsubscribeKeys(keys)
+	return
+}
+
+// waitHeartbeat blocking wait the websocket client heartbeat and ack command
+// till the conn closed, timedout or the client sent unknown data.
+// heartbeat: h
+// ack: ack mid (multiple keys: ack key mid)
+func waitHeartbeat(ws *websocket.Conn, key string, heartbeat int, ack ackFunc) {
+	var err error
+
 	reply := ""
 	begin := time.Now().UnixNano()
 	end := begin + oneSecond
@@ -163,6 +242,10 @@ func SubscribeHandle(ws *websocket.Conn) {
 			}
 
 			LogError(LogLevelInfo, "device:%s receive heartbeat", key)
+		} else if args := strings.Fields(reply); len(args) > 0 && args[0] == ackCmd {
+			if err = ack(args[1:]); err != nil {
+				break
+			}
 		} else {
 			LogError(LogLevelWarn, "device:%s unknown heartbeat protocol", key)
 			break
@@ -170,11 +253,4 @@ func SubscribeHandle(ws *websocket.Conn) {
 
 		end = time.Now().UnixNano()
 	}
-
-	// remove exists conn
-	if err := c.RemoveConn(ws, mid, key); err != nil {
-		LogError(LogLevelErr, "device:%s remove conn failed (%s)", key, err.Error())
-	}
-
-	return
 }
@@ -11,6 +11,9 @@ import (
 
 const (
 	fitstPacketTimedoutSec = 5
+	// a command can't have more arguments or longer argument than this
+	maxCmdArgNum  = 1024
+	maxCmdArgSize = 1024 * 1024
 )
 
 var (
@@ -23,9 +26,9 @@ type TCPReadBuf struct {
 
 // NewTCPReadBuf get a mutiple instance chan stored the bufio.Reader obj
 func NewTCPReadBuf() *TCPReadBuf {
-	readBufInstance := make([]chan *bufio.Reader, 0, Conf.ReadBufInstance)
-	for i := 0; i < Conf.ReadBufInstance; i++ {
-		readBufInstance = append(readBufInstance, make(chan *bufio.Reader, Conf.ReadBufNumPerInst))
+	readBufInstance := make([]chan *bufio.Reader, 0, Conf().ReadBufInstance)
+	for i := 0; i < Conf().ReadBufInstance; i++ {
+		readBufInstance = append(readBufInstance, make(chan *bufio.Reader, Conf().ReadBufNumPerInst))
 	}
 
 	return &TCPReadBuf{instance: readBufInstance}
@@ -38,7 +41,7 @@ func (b *TCPReadBuf) Get(conn io.Reader, idx int) *bufio.Reader {
 		rd.Reset(conn)
 		return rd
 	default:
-		return bufio.NewReaderSize(conn, Conf.ReadBufByte)
+		return bufio.NewReaderSize(conn, Conf().ReadBufByte)
 	}
 }
 
@@ -52,24 +55,20 @@ func (b *TCPReadBuf) Put(buf *bufio.Reader, idx int) {
 }
 
 func StartTCP() error {
-	addr, err := net.ResolveTCPAddr("tcp", Conf.Addr)
+	addr, err := net.ResolveTCPAddr("tcp", Conf().TCPAddr)
 	if err != nil {
-		LogError(LogLevelErr, "net.ResolveTCPAddr(\"tcp\"), %s) failed (%s)", Conf.Addr, err.Error())
+		LogError(LogLevelErr, "net.ResolveTCPAddr(\"tcp\"), %s) failed (%s)", Conf().TCPAddr, err.Error())
 		return err
 	}
 
 	l, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		LogError(LogLevelErr, "net.ListenTCP(\"tcp4\", \"%s\") failed (%s)", Conf.Addr, err.Error())
+		LogError(LogLevelErr, "net.ListenTCP(\"tcp4\", \"%s\") failed (%s)", Conf().TCPAddr, err.Error())
 		return err
 	}
 
-	// free the listener resource
-	defer func() {
-		if err := l.Close(); err != nil {
-			LogError(LogLevelErr, "listener.Close() failed (%s)", err.Error())
-		}
-	}()
+	// closed when shutdown
+	addListener(l)
 
 	// init reader buffer instance
 	rb := NewTCPReadBuf()
@@ -78,24 +77,29 @@ func StartTCP() error {
 	for {
 		conn, err := l.AcceptTCP()
 		if err != nil {
+			if isShutdown() {
+				LogError(LogLevelInfo, "tcp listener closed, stop accepting")
+				return nil
+			}
+
 			LogError(LogLevelErr, "listener.AcceptTCP() failed (%s)", err.Error())
 			continue
 		}
 
-		if err = conn.SetKeepAlive(Conf.TCPKeepAlive == 1); err != nil {
+		if err = conn.SetKeepAlive(Conf().TCPKeepAlive == 1); err != nil {
 			LogError(LogLevelErr, "conn.SetKeepAlive() failed (%s)", err.Error())
 			conn.Close()
 			continue
 		}
 
-		if err = conn.SetReadBuffer(Conf.ReadBufByte); err != nil {
-			LogError(LogLevelErr, "conn.SetReadBuffer(%d) failed (%s)", Conf.ReadBufByte, err.Error())
+		if err = conn.SetReadBuffer(Conf().ReadBufByte); err != nil {
+			LogError(LogLevelErr, "conn.SetReadBuffer(%d) failed (%s)", Conf().ReadBufByte, err.Error())
 			conn.Close()
 			continue
 		}
 
-		if err = conn.SetWriteBuffer(Conf.WriteBufByte); err != nil {
-			LogError(LogLevelErr, "conn.SetWriteBuffer(%d) failed (%s)", Conf.WriteBufByte, err.Error())
+		if err = conn.SetWriteBuffer(Conf().WriteBufByte); err != nil {
+			LogError(LogLevelErr, "conn.SetWriteBuffer(%d) failed (%s)", Conf().WriteBufByte, err.Error())
 			conn.Close()
 			continue
 		}
@@ -106,9 +110,17 @@ func StartTCP() error {
 			break
 		}
 
+		// limit the conn number
+		if err = connLimiter.Acquire(conn.RemoteAddr()); err != nil {
+			LogError(LogLevelWarn, "client:%s rejected (%s)", conn.RemoteAddr().String(), err.Error())
+			conn.Close()
+			continue
+		}
+
+		subConns.Add(conn)
 		go handleTCPConn(conn, round, rb)
 		round++
-		if round == Conf.ReadBufInstance {
+		if round == Conf().ReadBufInstance {
 			round = 0
 		}
 	}
@@ -122,38 +134,182 @@ func handleTCPConn(conn net.Conn, round int, rb *TCPReadBuf) {
 	// parse protocol reference: http://redis.io/topics/protocol (use redis protocol)
 	// get a bufio.reader
 	rd := rb.Get(conn, round)
-	if args, err := parseCmd(rd); err == nil {
-		// return buffer bufio.Reader
-		rb.Put(rd, round)
-		switch args[0] {
-		case "sub":
-			SubscribeTCPHandle(conn, args[1:])
-			break
-		default:
-			LogError(LogLevelWarn, "tcp proto:unknown cmd \"%s\"", args[0])
-			break
-		}
-	} else {
-		// return buffer bufio.Reader
-		rb.Put(rd, round)
-		LogError(LogLevelErr, "parseCmd() failed (%s)", err.Error())
-	}
-
+	s := newTCPSession(conn, rd)
+	s.serve()
+	// remove all the subscribed keys
+	s.close()
+	// return buffer bufio.Reader
+	rb.Put(rd, round)
 	// close the connection
 	if err := conn.Close(); err != nil {
 		LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
 	}
 
+	subConns.Remove(conn)
+	connLimiter.Release(conn.RemoteAddr())
 	LogError(LogLevelInfo, "handleTcpConn routine stop")
 	return
 }
 
-// SubscribeTCPHandle handle the subscribers's connection
-func SubscribeTCPHandle(conn net.Conn, args []string) {
+// tcpSession is the command loop of a tcp conn, the client commands use the
+// redis protocol, the replies:
+// sub, msub: h (ready heartbeat, same as the old protocol)
+// status: +OK\r\n
+// error: -ERR message\r\n
+// integer: :n\r\n
+// The client heartbeat is the single byte h.
+type tcpSession struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	w    *ConnWriter
+	// subscribed keys
+	keys map[string]*subKey
+	// keys authed by the auth command
+	authed map[string]bool
+	// keys allowed publishing by the signed token, the token expire unix
+	// second
+	pubs map[string]int64
+	// read timedout second
+	timeout int
+	// the last reply written after the writer closed
+	last string
+}
+
+func newTCPSession(conn net.Conn, rd *bufio.Reader) *tcpSession {
+	return &tcpSession{
+		conn:    conn,
+		rd:      rd,
+		w:       NewConnWriter(conn),
+		keys:    map[string]*subKey{},
+		authed:  map[string]bool{},
+		pubs:    map[string]int64{},
+		timeout: fitstPacketTimedoutSec,
+	}
+}
+
+// serve read and handle the commands till the conn closed, timedout, the
+// client sent a broken frame or reply failed.
+func (s *tcpSession) serve() {
+	var (
+		err   error
+		reply byte
+		args  []string
+	)
+
+	addr := s.conn.RemoteAddr().String()
+	begin := time.Now().UnixNano()
+	end := begin + oneSecond
+	for {
+		// more then 1 sec, reset the timer
+		if end-begin >= oneSecond {
+			if err = s.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(s.timeout))); err != nil {
+				LogError(LogLevelErr, "conn.SetReadDeadLine() failed (%s)", err.Error())
+				break
+			}
+
+			begin = end
+		}
+
+		if reply, err = s.rd.ReadByte(); err != nil {
+			if err != io.EOF {
+				LogError(LogLevelErr, "client:%s conn.Read() failed, read timedout (%s)", addr, err.Error())
+			} else {
+				// client connection close
+				LogError(LogLevelInfo, "client:%s client connection close", addr)
+			}
+
+			break
+		}
+
+		if reply == heartbeatBytes[0] {
+			if _, err = s.conn.Write(heartbeatBytes); err != nil {
+				LogError(LogLevelErr, "client:%s conn.Write() failed, write heartbeat to client (%s)", addr, err.Error())
+				break
+			}
+
+			LogError(LogLevelInfo, "client:%s receive heartbeat", addr)
+		} else if reply == '*' {
+			if err = s.rd.UnreadByte(); err != nil {
+				LogError(LogLevelErr, "client:%s rd.UnreadByte() failed (%s)", addr, err.Error())
+				break
+			}
+
+			if args, err = parseCmd(s.rd); err != nil {
+				// the frame broken, can't continue
+				LogError(LogLevelErr, "client:%s parseCmd() failed (%s)", addr, err.Error())
+				s.last = "-ERR protocol error\r\n"
+				break
+			}
+
+			if err = s.handle(args); err != nil {
+				LogError(LogLevelErr, "client:%s reply \"%s\" failed (%s)", addr, args[0], err.Error())
+				break
+			}
+		} else {
+			LogError(LogLevelWarn, "client:%s unknown protocol", addr)
+			s.last = "-ERR unknown protocol\r\n"
+			break
+		}
+
+		end = time.Now().UnixNano()
+	}
+}
+
+// handle dispatch the command, only return the reply error.
+func (s *tcpSession) handle(args []string) error {
+	switch args[0] {
+	case "sub":
+		return s.sub(args[1:])
+	case "msub":
+		return s.msub(args[1:])
+	case "unsub":
+		return s.unsub(args[1:])
+	case ackCmd:
+		return s.ack(args[1:])
+	case "ping":
+		return s.reply("+PONG\r\n")
+	case "auth":
+		return s.auth(args[1:])
+	case "pub":
+		return s.pub(args[1:])
+	default:
+		LogError(LogLevelWarn, "tcp proto:unknown cmd \"%s\"", args[0])
+		return s.replyErr("unknown command " + args[0])
+	}
+}
+
+// close remove the conn from all the subscribed keys, stop the writer then
+// write the last reply if any.
+func (s *tcpSession) close() {
+	for key, k := range s.keys {
+		unsubscribeKeys([]*subKey{k})
+		delete(s.keys, key)
+	}
+
+	s.w.Close()
+	if s.last == "" {
+		return
+	}
+
+	// the write routine exit, write directly
+	s.w.wait()
+	err := s.conn.SetWriteDeadline(time.Now().Add(s.w.timeout))
+	if err == nil {
+		_, err = s.conn.Write([]byte(s.last))
+	}
+
+	if err != nil {
+		LogError(LogLevelErr, "client:%s conn.Write() failed (%s)", s.conn.RemoteAddr().String(), err.Error())
+	}
+}
+
+// sub subscribe a key, the frames not tagged with the key,
+// args: key, mid, [heartbeat], [token]
+func (s *tcpSession) sub(args []string) error {
 	argLen := len(args)
 	if argLen < 2 {
 		LogError(LogLevelWarn, "subscriber missing argument")
-		return
+		return s.replyErr("missing argument")
 	}
 
 	// key, mid, heartbeat, token
@@ -162,26 +318,22 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 	mid, err := strconv.ParseInt(midStr, 10, 64)
 	if err != nil {
 		LogError(LogLevelErr, "mid:\"%s\" argument error (%s)", midStr, err.Error())
-		return
+		return s.replyErr("mid argument error")
 	}
 
-	heartbeat := Conf.HeartbeatSec
-	heartbeatStr := ""
+	heartbeat := Conf().HeartbeatSec
 	if argLen > 2 {
-		heartbeatStr = args[2]
-		i, err := strconv.Atoi(heartbeatStr)
-		if err != nil {
+		heartbeatStr := args[2]
+		if heartbeat, err = strconv.Atoi(heartbeatStr); err != nil {
 			LogError(LogLevelErr, "heartbeat:\"%s\" argument error (%s)", heartbeatStr, err.Error())
-			return
+			return s.replyErr("heartbeat argument error")
 		}
-
-		heartbeat = i
 	}
 
 	heartbeat *= 2
 	if heartbeat <= 0 {
 		LogError(LogLevelWarn, "device:%s heartbeat argument error, less than 0", key)
-		return
+		return s.replyErr("heartbeat argument error")
 	}
 
 	token := ""
@@ -189,95 +341,224 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 		token = args[3]
 	}
 
-	LogError(LogLevelInfo, "client:%s subscribe to key = %s, mid = %d, token = %s, heartbeat = %d", conn.RemoteAddr().String(), key, mid, token, heartbeat)
-	// fetch subscriber from the channel
-	c, err := channel.Get(key)
+	LogError(LogLevelInfo, "client:%s subscribe to key = %s, mid = %d, token = %s, heartbeat = %d", s.conn.RemoteAddr().String(), key, mid, token, heartbeat)
+	return s.subscribe([]*subKey{&subKey{key: key, mid: mid, token: token}}, heartbeat, false)
+}
+
+// msub subscribe multiple keys, the frames tagged with the key,
+// args: heartbeat, key1, mid1, token1, key2, mid2, token2...
+func (s *tcpSession) msub(args []string) error {
+	argLen := len(args)
+	if argLen < 4 || (argLen-1)%3 != 0 {
+		LogError(LogLevelWarn, "multiple subscriber argument number error")
+		return s.replyErr("argument number error")
+	}
+
+	heartbeatStr := args[0]
+	heartbeat, err := strconv.Atoi(heartbeatStr)
 	if err != nil {
-		if Conf.Auth == 0 {
-			c, err = channel.New(key)
-			if err != nil {
-				LogError(LogLevelErr, "device:%s can't create channle (%s)", key, err.Error())
-				return
-			}
-		} else {
-			LogError(LogLevelWarn, "device:%s can't get a channel (%s)", key, err.Error())
-			return
+		LogError(LogLevelErr, "heartbeat:\"%s\" argument error (%s)", heartbeatStr, err.Error())
+		return s.replyErr("heartbeat argument error")
+	}
+
+	if heartbeat == 0 {
+		heartbeat = Conf().HeartbeatSec
+	}
+
+	heartbeat *= 2
+	if heartbeat <= 0 {
+		LogError(LogLevelWarn, "heartbeat argument error, less than 0")
+		return s.replyErr("heartbeat argument error")
+	}
+
+	keys := make([]*subKey, 0, (argLen-1)/3)
+	for i := 1; i < argLen; i += 3 {
+		mid, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			LogError(LogLevelErr, "mid:\"%s\" argument error (%s)", args[i+1], err.Error())
+			return s.replyErr("mid argument error")
 		}
+
+		keys = append(keys, &subKey{key: args[i], mid: mid, token: args[i+2]})
+	}
+
+	LogError(LogLevelInfo, "client:%s subscribe to keys = %s, heartbeat = %d", s.conn.RemoteAddr().String(), subKeysString(keys), heartbeat)
+	return s.subscribe(keys, heartbeat, true)
+}
+
+// subscribe add the keys to the session, reply the ready heartbeat if
+// succeed.
+func (s *tcpSession) subscribe(keys []*subKey, heartbeat int, tag bool) error {
+	if Conf().MaxSubKeyPerConn > 0 && len(s.keys)+len(keys) > Conf().MaxSubKeyPerConn {
+		return s.replyErr(MaxSubKeyErr.Error())
 	}
 
-	// auth
-	if Conf.Auth == 1 {
-		if err = c.AuthToken(token, key); err != nil {
-			LogError(LogLevelErr, "device:%s auth token failed \"%s\" (%s)", key, token, err.Error())
-			return
+	for _, k := range keys {
+		if _, ok := s.keys[k.key]; ok {
+			return s.replyErr(SubKeyExistErr.Error())
 		}
+
+		k.authed = s.authed[k.key]
 	}
 
-	// send first heartbeat to tell client service is ready for accept heartbeat
-	if _, err := conn.Write(heartbeatBytes); err != nil {
-		LogError(LogLevelErr, "device:%s write first heartbeat to client failed (%s)", key, err.Error())
-		return
+	// subscribeKeys reply the ready heartbeat if succeed
+	if err := subscribeKeys(s.w, TCPProtocol, keys, tag); err != nil {
+		LogError(LogLevelErr, "client:%s subscribe keys failed (%s)", s.conn.RemoteAddr().String(), err.Error())
+		return s.replyErr(err.Error())
 	}
 
-	// send stored message, and use the last message id if sent any
-	if err = c.SendMsg(conn, mid, key); err != nil {
-		LogError(LogLevelErr, "device:%s send offline message failed (%s)", key, err.Error())
-		return
+	for _, k := range keys {
+		s.keys[k.key] = k
 	}
 
-	// add a conn to the channel
-	if err = c.AddConn(conn, mid, key); err != nil {
-		LogError(LogLevelErr, "device:%s add conn failed (%s)", key, err.Error())
-		return
+	s.timeout = heartbeat
+	return nil
+}
+
+// unsub unsubscribe the key, reply :1 if removed, :0 if not subscribed,
+// args: key
+func (s *tcpSession) unsub(args []string) error {
+	if len(args) != 1 {
+		return s.replyErr("argument number error")
 	}
 
-	// blocking wait client heartbeat
-	reply := make([]byte, heartbeatByteLen)
-	begin := time.Now().UnixNano()
-	end := begin + oneSecond
-	for {
-		// more then 1 sec, reset the timer
-		if end-begin >= oneSecond {
-			if err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
-				LogError(LogLevelErr, "conn.SetReadDeadLine() failed (%s)", err.Error())
-				break
-			}
+	k, ok := s.keys[args[0]]
+	if !ok {
+		return s.reply(":0\r\n")
+	}
 
-			begin = end
+	unsubscribeKeys([]*subKey{k})
+	delete(s.keys, k.key)
+	return s.reply(":1\r\n")
+}
+
+// ack advance the acked message id, args: [key], mid. The key can be omitted
+// if only one key subscribed.
+func (s *tcpSession) ack(args []string) error {
+	var k *subKey
+
+	if len(args) == 1 && len(s.keys) == 1 {
+		for _, k = range s.keys {
 		}
+	} else if len(args) == 2 {
+		k = s.keys[args[0]]
+		args = args[1:]
+	}
 
-		if _, err = conn.Read(reply); err != nil {
-			if err != io.EOF {
-				LogError(LogLevelErr, "device:%s conn.Read() failed, read heartbeat timedout (%s)", key, err.Error())
-			} else {
-				// client connection close
-				LogError(LogLevelInfo, "device:%s client connection close", key)
-			}
+	if k == nil {
+		return s.replyErr("ack argument error")
+	}
 
-			break
+	if err := ackMsg(k.c, args[0], k.key); err != nil {
+		return s.replyErr(err.Error())
+	}
+
+	return s.reply("+OK\r\n")
+}
+
+// auth auth the token for the key, the following sub needn't the token,
+// the signed token grant sub and pub by the permissions, args: key, token
+func (s *tcpSession) auth(args []string) error {
+	if len(args) != 2 {
+		return s.replyErr("argument number error")
+	}
+
+	key, token := args[0], args[1]
+	if Conf().Auth == AuthSigned {
+		t, err := ParseToken(token)
+		if err == nil && t.Key != key {
+			err = TokenKeyErr
+		} else if err == nil && !t.Allow(TokenPermSub) && !t.Allow(TokenPermPub) {
+			err = TokenPermErr
 		}
 
-		if string(reply) == heartbeatMsg {
-			if _, err = conn.Write(heartbeatBytes); err != nil {
-				LogError(LogLevelErr, "device:%s conn.Write() failed, write heartbeat to client (%s)", key, err.Error())
-				break
-			}
+		if err != nil {
+			chStat.IncrAuthFailed()
+			LogError(LogLevelErr, "device:%s verify token failed \"%s\" (%s)", key, token, err.Error())
+			return s.replyErr(err.Error())
+		}
 
-			LogError(LogLevelInfo, "device:%s receive heartbeat", key)
-		} else {
-			LogError(LogLevelWarn, "device:%s unknown heartbeat protocol", key)
-			break
+		if t.Allow(TokenPermSub) {
+			s.authed[key] = true
 		}
 
-		end = time.Now().UnixNano()
+		if t.Allow(TokenPermPub) {
+			s.pubs[key] = t.Expire
+		}
+
+		return s.reply("+OK\r\n")
 	}
 
-	// remove exists conn
-	if err := c.RemoveConn(conn, mid, key); err != nil {
-		LogError(LogLevelErr, "device:%s remove conn failed (%s)", key, err.Error())
+	if Conf().Auth != AuthNone {
+		if _, err := subAuthChannel(key, token, false); err != nil {
+			return s.replyErr(err.Error())
+		}
 	}
 
-	return
+	s.authed[key] = true
+	return s.reply("+OK\r\n")
+}
+
+// pub publish a message if Conf().TCPPub enabled, reply the message id,
+// args: key, msg, [expire]
+func (s *tcpSession) pub(args []string) error {
+	if Conf().TCPPub != 1 {
+		return s.replyErr("pub not allowed")
+	}
+
+	if len(args) < 2 {
+		return s.replyErr("missing argument")
+	}
+
+	key := args[0]
+	// the signed token must allow publishing the key, otherwise the key must
+	// be authed or subscribed by this session
+	if Conf().Auth == AuthSigned {
+		expire, ok := s.pubs[key]
+		if !ok {
+			return s.replyErr(TokenPermErr.Error())
+		}
+
+		if time.Now().Unix() > expire {
+			delete(s.pubs, key)
+			return s.replyErr(TokenExpiredErr.Error())
+		}
+	} else if _, ok := s.keys[key]; !ok && !s.authed[key] {
+		return s.replyErr("pub not authed")
+	}
+
+	expire := Conf().MessageExpireSec
+	if len(args) > 2 {
+		var err error
+		if expire, err = strconv.ParseInt(args[2], 10, 64); err != nil || expire <= 0 {
+			return s.replyErr("expire argument error")
+		}
+	}
+
+	c, err := pubChannel(key)
+	if err != nil {
+		return s.replyErr(err.Error())
+	}
+
+	m := &Message{Msg: args[1], Expire: time.Now().UnixNano() + expire*Second, MsgID: AutoMsgID}
+	if ret := pushMsg(c, m, key); ret.Ret != retOK {
+		return s.replyErr("push msg failed")
+	} else {
+		return s.reply(":" + strconv.FormatInt(ret.Mid, 10) + "\r\n")
+	}
+}
+
+// reply queue the reply to the writer, so it's written with the write
+// deadline and in order with the pushed messages
+func (s *tcpSession) reply(r string) error {
+	buf := newWriteBuf()
+	buf.WriteString(r)
+	return s.w.WriteWait(buf)
+}
+
+// replyErr write the error reply to the client
+func (s *tcpSession) replyErr(msg string) error {
+	return s.reply("-ERR " + msg + "\r\n")
 }
 
 func parseCmd(rd *bufio.Reader) ([]string, error) {
@@ -288,8 +569,8 @@ func parseCmd(rd *bufio.Reader) ([]string, error) {
 		return nil, err
 	}
 
-	if argNum < 1 {
-		LogError(LogLevelWarn, "tcp proto cmd:cmd argument number length error")
+	if argNum < 1 || argNum > maxCmdArgNum {
+		LogError(LogLevelWarn, "tcp proto cmd:cmd argument number %d error", argNum)
 		return nil, CmdFmtErr
 	}
 
@@ -341,21 +622,26 @@ func parseCmdSize(rd *bufio.Reader, prefix uint8) (int, error) {
 	return cmdSize, nil
 }
 
-// parseCmdData get the sub request protocol cmd data not included \r\n
+// parseCmdData get the sub request protocol cmd data not included \r\n, the
+// data is binary safe
 func parseCmdData(rd *bufio.Reader, cmdLen int) ([]byte, error) {
-	d, err := rd.ReadBytes('\n')
-	if err != nil {
-		LogError(LogLevelErr, "tcp proto cmd:rd.ReadBytes('\\n') failed (%s)", err.Error())
+	if cmdLen < 0 || cmdLen > maxCmdArgSize {
+		LogError(LogLevelWarn, "tcp proto cmd:argument length %d error", cmdLen)
+		return nil, CmdFmtErr
+	}
+
+	d := make([]byte, cmdLen+2)
+	if _, err := io.ReadFull(rd, d); err != nil {
+		LogError(LogLevelErr, "tcp proto cmd:io.ReadFull() failed (%s)", err.Error())
 		return nil, err
 	}
 
-	dl := len(d)
 	// check last \r\n
-	if dl != cmdLen+2 || d[dl-2] != '\r' {
-		LogError(LogLevelWarn, "tcp proto cmd:\"%v\"(%d) number format error, length error or no \\r", d, dl)
+	if d[cmdLen] != '\r' || d[cmdLen+1] != '\n' {
+		LogError(LogLevelWarn, "tcp proto cmd:\"%v\"(%d) format error, no \\r\\n", d, cmdLen)
 		return nil, CmdFmtErr
 	}
 
 	// skip last \r\n
-	return d[0 : dl-2], nil
+	return d[:cmdLen], nil
 }
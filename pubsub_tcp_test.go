@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"github.com/Terry-Mao/gopush2/admin"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPSession(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1})
+	InitWriteBuf()
+	tests := []struct {
+		cmd   string
+		reply string
+	}{
+		{"*1\r\n$4\r\nping\r\n", "+PONG\r\n"},
+		{"*2\r\n$5\r\nunsub\r\n$9\r\nTerry-Mao\r\n", ":0\r\n"},
+		{"*2\r\n$3\r\nack\r\n$1\r\n1\r\n", "-ERR ack argument error\r\n"},
+		{"*3\r\n$3\r\npub\r\n$9\r\nTerry-Mao\r\n$4\r\ntest\r\n", "-ERR pub not allowed\r\n"},
+		{"*1\r\n$3\r\nfoo\r\n", "-ERR unknown command foo\r\n"},
+		{"h", "h"},
+		{"x", "-ERR unknown protocol\r\n"},
+	}
+
+	s, c := net.Pipe()
+	sess := newTCPSession(s, bufio.NewReader(s))
+	done := make(chan bool)
+	go func() {
+		sess.serve()
+		sess.close()
+		s.Close()
+		sess.w.wait()
+		close(done)
+	}()
+
+	rd := bufio.NewReader(c)
+	for _, test := range tests {
+		if _, err := c.Write([]byte(test.cmd)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(test.reply))
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != test.reply {
+			t.Errorf("reply of %q must be %q, but %q", test.cmd, test.reply, string(buf))
+		}
+	}
+
+	// unknown protocol closed the conn
+	if _, err := rd.ReadByte(); err == nil {
+		t.Error("conn must be closed")
+	}
+
+	<-done
+}
+
+func TestTCPSessionPubNotAuthed(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1, TCPPub: 1, Auth: AuthStored})
+	InitWriteBuf()
+	s, c := net.Pipe()
+	sess := newTCPSession(s, bufio.NewReader(s))
+	done := make(chan bool)
+	go func() {
+		sess.serve()
+		sess.close()
+		s.Close()
+		sess.w.wait()
+		close(done)
+	}()
+
+	defer func() {
+		c.Close()
+		<-done
+	}()
+
+	if _, err := c.Write([]byte("*3\r\n$3\r\npub\r\n$9\r\nTerry-Mao\r\n$4\r\ntest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := "-ERR pub not authed\r\n"
+	buf := make([]byte, len(reply))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != reply {
+		t.Errorf("reply must be %q, but %q", reply, string(buf))
+	}
+}
+
+func TestTCPSessionAuthPub(t *testing.T) {
+	SetConf(&Config{WriteBufNum: 1, WriteBufByte: 64, WriteQueueSize: 1, WriteTimeoutSec: 1, TCPPub: 1, Auth: AuthSigned, AuthKeys: map[string]string{"k1": "0123456789abcdef"}})
+	InitWriteBuf()
+	pub, err := admin.SignToken("k1", "0123456789abcdef", "Terry-Mao", time.Minute, admin.PermPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, c := net.Pipe()
+	sess := newTCPSession(s, bufio.NewReader(s))
+	// the token of other expired
+	sess.pubs["other"] = time.Now().Unix() - 1
+	done := make(chan bool)
+	go func() {
+		sess.serve()
+		sess.close()
+		s.Close()
+		sess.w.wait()
+		close(done)
+	}()
+
+	defer func() {
+		c.Close()
+		<-done
+	}()
+
+	tests := []struct {
+		cmd   string
+		reply string
+	}{
+		// the pub only token granted pub, not sub
+		{"*3\r\n$4\r\nauth\r\n$9\r\nTerry-Mao\r\n$" + strconv.Itoa(len(pub)) + "\r\n" + pub + "\r\n", "+OK\r\n"},
+		{"*3\r\n$4\r\nauth\r\n$5\r\nother\r\n$" + strconv.Itoa(len(pub)) + "\r\n" + pub + "\r\n", "-ERR " + TokenKeyErr.Error() + "\r\n"},
+		{"*3\r\n$3\r\npub\r\n$5\r\nother\r\n$4\r\ntest\r\n", "-ERR " + TokenExpiredErr.Error() + "\r\n"},
+		{"*3\r\n$3\r\npub\r\n$5\r\nother\r\n$4\r\ntest\r\n", "-ERR " + TokenPermErr.Error() + "\r\n"},
+	}
+
+	rd := bufio.NewReader(c)
+	for _, test := range tests {
+		if _, err := c.Write([]byte(test.cmd)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(test.reply))
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != test.reply {
+			t.Errorf("reply of %q must be %q, but %q", test.cmd, test.reply, string(buf))
+		}
+	}
+
+	if sess.authed["Terry-Mao"] || sess.pubs["Terry-Mao"] == 0 {
+		t.Errorf("the pub only token must grant pub only, but sub %t, pub %d", sess.authed["Terry-Mao"], sess.pubs["Terry-Mao"])
+	}
+}
+
+func TestParseCmd(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		err  error
+	}{
+		{"*3\r\n$3\r\npub\r\n$9\r\nTerry-Mao\r\n$12\r\nhello\r\nworld\r\n", []string{"pub", "Terry-Mao", "hello\r\nworld"}, nil},
+		{"*1\r\n$4\r\nping\r\n", []string{"ping"}, nil},
+		{"*1\r\n$4\r\npingxx", nil, CmdFmtErr},
+		{"*1\r\n$-1\r\n", nil, CmdFmtErr},
+		{"*100000\r\n", nil, CmdFmtErr},
+	}
+
+	for _, test := range tests {
+		args, err := parseCmd(bufio.NewReader(strings.NewReader(test.cmd)))
+		if err != test.err {
+			t.Errorf("parse %q error must be %v, but %v", test.cmd, test.err, err)
+			continue
+		}
+
+		if strings.Join(args, " ") != strings.Join(test.args, " ") {
+			t.Errorf("parse %q must be %q, but %q", test.cmd, test.args, args)
+		}
+	}
+}
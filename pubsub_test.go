@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPubMsgID(t *testing.T) {
+	tests := []struct {
+		mid string
+		id  int64
+		err bool
+	}{
+		{"", AutoMsgID, false},
+		{"0", AutoMsgID, false},
+		{"10", 10, false},
+		{"-1", 0, true},
+		{"x", 0, true},
+	}
+
+	for _, test := range tests {
+		params := url.Values{}
+		if test.mid != "" {
+			params.Set("mid", test.mid)
+		}
+
+		id, err := pubMsgID(params)
+		if (err != nil) != test.err {
+			t.Errorf("mid %q error must be %v, but (%v)", test.mid, test.err, err)
+			continue
+		}
+
+		if id != test.id {
+			t.Errorf("mid %q must be %d, but %d", test.mid, test.id, id)
+		}
+	}
+}
+
+func TestChannelHandleAddTokenFailed(t *testing.T) {
+	SetConf(&Config{ChannelExpireSec: 60, ChannelBucket: 16, ChannelType: InnerChannelType})
+	old := channel
+	channel = NewChannelList()
+	defer func() { channel = old }()
+
+	// the token used twice, only the add token failed ret written
+	rets := []int{retOK, retAddToken}
+	for _, ret := range rets {
+		w := httptest.NewRecorder()
+		ChannelHandle(w, httptest.NewRequest("GET", "/ch?key=Terry-Mao&token=test", nil))
+		body := w.Body.String()
+		dec := json.NewDecoder(strings.NewReader(body))
+		res := &struct {
+			Ret int `json:"ret"`
+		}{}
+		if err := dec.Decode(res); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Ret != ret {
+			t.Errorf("ret must be %d, but %d", ret, res.Ret)
+		}
+
+		if dec.More() {
+			t.Errorf("only one ret must be written, but %q", body)
+		}
+	}
+}
+
+func TestNewPubMsg(t *testing.T) {
+	m, err := newPubMsg("hello \"Terry\"<>", 0, AutoMsgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the copies share the encoded msg, only splice the message id
+	c := m.Copy()
+	c.MsgID = 5
+	if &c.body[0] != &m.body[0] {
+		t.Error("the copy must share the encoded msg")
+	}
+
+	b, err := c.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := json.Marshal(map[string]interface{}{"mid": 5, "msg": "hello \"Terry\"<>"})
+	if string(b) != string(want) {
+		t.Errorf("message json must be %s, but %s", want, b)
+	}
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"github.com/Terry-Mao/gopush2/hash"
 	"github.com/garyburd/redigo/redis"
-	"net"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const (
-	msgRedisPre    = "m_"
-	onlineRedisPre = "o_"
-	tokenRedisPre  = "t_"
-
-	defaultRedisNode = "node1"
+	RedisChannelType = 2
+	msgRedisPre      = "m_"
+	onlineRedisPre   = "o_"
+	tokenRedisPre    = "t_"
+	msgIDRedisPre    = "i_"
+	ackRedisPre      = "a_"
+	redisVNode       = 255
+	// offline messages per page
+	redisReplayPage = 50
+	// connect timeout of the pooled conns
+	redisConnectTimeout = 3 * time.Second
 )
 
 var (
@@ -24,234 +29,352 @@ var (
 	RedisNoConnErr = errors.New("can't get a redis conn")
 	RedisDataErr   = errors.New("redis data fatal error")
 	redisPool      = map[string]*redis.Pool{}
+	// guard the redisPool map, replaced by reload
+	redisPoolMutex = &sync.RWMutex{}
 	redisHash      *hash.Ketama
+	// the store shared by all the keys
+	redisStore = &RedisStore{}
+	// publish the messages of the keys which no local channel
+	redisPubChannel *StoreChannel
+	// set the acked message id if greate than the stored one, extend the
+	// ttl to the messages' at least, so the acked messages not resent
+	ackScript = redis.NewScript(2, `
+local acked = tonumber(redis.call("GET", KEYS[1]) or "0")
+local mid = tonumber(ARGV[1])
+if mid > acked then
+	redis.call("SET", KEYS[1], ARGV[1])
+	acked = mid
+end
+local ttl = math.max(tonumber(ARGV[2]), redis.call("PTTL", KEYS[2]))
+if redis.call("PTTL", KEYS[1]) < ttl then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return acked`)
+	// allocate the message id (INCR) or advance the counter to the supplied
+	// id, store the message, trim to the max stored number, extend the keys
+	// ttl, then publish it, all in one atomic step, so the messages stored
+	// and published in the id order. The member is the json of the Message.
+	pushScript = redis.NewScript(2, `
+local mid = ARGV[1]
+if mid == "0" then
+	mid = string.format("%d", redis.call("INCR", KEYS[2]))
+elseif tonumber(mid) > tonumber(redis.call("GET", KEYS[2]) or "0") then
+	redis.call("SET", KEYS[2], mid)
+end
+local idttl = tonumber(ARGV[6])
+if redis.call("PTTL", KEYS[2]) < idttl then
+	redis.call("PEXPIRE", KEYS[2], idttl)
+end
+local member = '{"msg":' .. ARGV[2] .. ',"expire":' .. ARGV[3] .. ',"mid":' .. mid .. '}'
+redis.call("ZADD", KEYS[1], mid, member)
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -(tonumber(ARGV[4]) + 1))
+local ttl = tonumber(ARGV[5])
+if redis.call("PTTL", KEYS[1]) < ttl then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+redis.call("PUBLISH", ARGV[7], member)
+return mid`)
 )
 
-type RedisChannel struct {
-	// Mutex
-	mutex *sync.Mutex
-	// Client conn
-	conn map[net.Conn]int64
-	// Channel expired unixnano
-	expire int64
-	// write buffer chan for message sent
-	writeBuf chan *bytes.Buffer
+func init() {
+	RegisterChannelBackend(RedisChannelType, &ChannelBackend{
+		Name: "redis_channel",
+		Init: func(l *ChannelList) error { return InitRedisChannel() },
+		New: func(key string) (MessageStore, TokenStore, error) {
+			return redisStore, redisStore, nil
+		},
+	})
 }
 
+// RedisStore is the message and token store of all the keys in redis, the
+// saved messages published to all the nodes subscribed the key.
+type RedisStore struct{}
+
 // Init redis channel, such as init redis pool, init consistent hash ring
 func InitRedisChannel() error {
-	if Conf.Redis == nil || len(Conf.Redis) == 0 {
+	if Conf().Redis == nil || len(Conf().Redis) == 0 {
 		LogError(LogLevelWarn, "not configure redis node in config file")
 		return ConfigRedisErr
 	}
 
 	// redis pool
-	for n, c := range Conf.Redis {
-		// WARN: closures use
-		tc := c
-		redisPool[n] = &redis.Pool{
-			MaxIdle:     tc.Idle,
-			MaxActive:   tc.Active,
-			IdleTimeout: time.Duration(tc.Timeout) * time.Second,
-			Dial: func() (redis.Conn, error) {
-				conn, err := redis.Dial(tc.Network, tc.Addr)
-				if err != nil {
-					LogError(LogLevelErr, "redis.Dial(\"%s\", \"%s\") failed (%s)", tc.Network, tc.Addr, err.Error())
-				}
-				return conn, err
-			},
-		}
+	weights := map[string]int{}
+	redisPoolMutex.Lock()
+	for n, c := range Conf().Redis {
+		weights[n] = c.Weight
+		redisPool[n] = newRedisPool(c)
 	}
+	redisPoolMutex.Unlock()
 
 	// consistent hashing
-	redisHash = hash.NewKetama(len(redisPool), 255)
+	redisHash = hash.NewKetamaNodes(weights, redisVNode)
+	// eject and re-admit the shards
+	StartRedisHealthCheck()
+	redisPubChannel = NewStoreChannel("", redisStore, redisStore)
+	// receive the messages published by all the nodes
+	InitRedisSubscriber()
 	return nil
 }
 
-// New a redis message stored channel
-func NewRedisChannel() *RedisChannel {
-	c := &RedisChannel{}
-	c.mutex = &sync.Mutex{}
-	c.conn = map[net.Conn]int64{}
-	c.expire = time.Now().UnixNano() + Conf.ChannelExpireSec*Second
-	c.writeBuf = make(chan *bytes.Buffer, Conf.WriteBufNum)
-
-	return c
+// newRedisPool new a redis pool of the node config
+func newRedisPool(c *RedisConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     c.Idle,
+		MaxActive:   c.Active,
+		IdleTimeout: time.Duration(c.Timeout) * time.Second,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial(c.Network, c.Addr, redis.DialConnectTimeout(redisConnectTimeout))
+			if err != nil {
+				LogError(LogLevelErr, "redis.Dial(\"%s\", \"%s\") failed (%s)", c.Network, c.Addr, err.Error())
+			}
+			return conn, err
+		},
+	}
 }
 
-// newWriteBuf get a buf from channel or create a new buf if chan is empty
-func (c *RedisChannel) newWriteBuf() *bytes.Buffer {
-	select {
-	case buf := <-c.writeBuf:
-		buf.Reset()
-		return buf
-	default:
-		return bytes.NewBuffer(make([]byte, Conf.WriteBufByte))
+// reloadRedisPool replace the redis pools by the new pool sizes, the old
+// pools closed, the conns in use closed when returned
+func reloadRedisPool(rc map[string]*RedisConfig) {
+	pools := map[string]*redis.Pool{}
+	for name, c := range rc {
+		pools[name] = newRedisPool(c)
+	}
+
+	redisPoolMutex.Lock()
+	old := redisPool
+	redisPool = pools
+	redisPoolMutex.Unlock()
+	for _, p := range old {
+		p.Close()
 	}
 }
 
-func (c *RedisChannel) putWriteBuf(buf *bytes.Buffer) {
-	select {
-	case c.writeBuf <- buf:
-	default:
+// getRedisPool get the pool of the redis node, nil if not exists
+func getRedisPool(node string) *redis.Pool {
+	redisPoolMutex.RLock()
+	defer redisPoolMutex.RUnlock()
+	return redisPool[node]
+}
+
+// redisNodes get all the redis node names
+func redisNodes() []string {
+	redisPoolMutex.RLock()
+	defer redisPoolMutex.RUnlock()
+	nodes := make([]string, 0, len(redisPool))
+	for node, _ := range redisPool {
+		nodes = append(nodes, node)
 	}
+
+	return nodes
 }
 
-// PushMsg implements the Channel PushMsg method.
-func (c *RedisChannel) PushMsg(m *Message, key string) error {
-	// fetch a write buf, return back after call end
-	buf := c.newWriteBuf()
-	defer c.putWriteBuf(buf)
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	// send message to each conn when message id > conn last message id
-	b, err := m.Bytes(buf)
-	if err != nil {
-		LogError(LogLevelErr, "message.Bytes(buf) failed (%s)", err.Error())
-		return err
+// Save implements the MessageStore Save method.
+func (s *RedisStore) Save(m *Message, key string) error {
+	// the message ttl in millisecond
+	ttl := (m.Expire - time.Now().UnixNano()) / int64(time.Millisecond)
+	if ttl <= 0 {
+		return MsgExpiredErr
 	}
 
-	for conn, mid := range c.conn {
-		// ignore message cause it's id less than mid
-		if mid >= m.MsgID {
-			LogError(LogLevelWarn, "device:%s ignore send message:%d, the last message id:%d", key, m.MsgID, mid)
-			continue
-		}
+	// keep the id counter while the message or the channel alive
+	idTTL := redisKeyTTL()
+	if ttl > idTTL {
+		idTTL = ttl
+	}
 
-		if _, err = conn.Write(b); err != nil {
-			LogError(LogLevelErr, "message write error, conn.Write() failed (%s)", err.Error())
-			continue
+	if m.body == nil {
+		if err := m.EncodeBody(); err != nil {
+			return err
 		}
+	}
+
+	rc := getRedisConn(key)
+	if rc == nil {
+		LogError(LogLevelWarn, "can't get a redis connection")
+		return RedisNoConnErr
+	}
 
-		// if succeed, update the last message id, conn.Write may failed but err == nil(client shutdown or sth else), but the message won't loss till next connect to sub
-		c.conn[conn] = m.MsgID
-		LogError(LogLevelInfo, "push message \"%s\":%d to device:%s", m.Msg, m.MsgID, key)
+	defer rc.Close()
+	// allocate the message id by redis atomic counter (INCR), so the id is
+	// increasing in all the nodes, the caller supplied id advance the
+	// counter. Every node subscribed the key push the message to it's conns,
+	// include this node (INCR, ZADD, ZREMRANGEBYRANK, PEXPIRE, PUBLISH by lua
+	// script)
+	mid, err := redis.Int64(pushScript.Do(rc, msgRedisPre+key, msgIDRedisPre+key, m.MsgID, m.body, m.Expire, Conf().MaxStoredMessage, ttl, idTTL, pubsubRedisPre+key))
+	if err != nil {
+		LogError(LogLevelErr, "redis push script(\"%s\", %d) failed (%s)", msgRedisPre+key, m.MsgID, err.Error())
+		return err
 	}
 
+	m.MsgID = mid
+	chStat.IncrMessage()
 	return nil
 }
 
-// SendMsg implements the Channel SendMsg method.
-func (c *RedisChannel) SendMsg(conn net.Conn, mid int64, key string) error {
-	// get offline message from redis which greate mid (ZRANGEBYSCORE)
-	// delete the expired message
-	// update the last message id for conn
-	// fetch a write buf, return back after call end
-	buf := c.newWriteBuf()
-	defer c.putWriteBuf(buf)
-	nmid := mid
+// Subscribe implements the Publisher Subscribe method.
+func (s *RedisStore) Subscribe(key string) {
+	redisSubscribe(key)
+}
+
+// Unsubscribe implements the Publisher Unsubscribe method.
+func (s *RedisStore) Unsubscribe(key string) {
+	redisUnsubscribe(key)
+}
+
+// Range implements the MessageStore Range method.
+func (s *RedisStore) Range(mid int64, key string, f func(m *Message) error) error {
 	rc := getRedisConn(key)
 	if rc == nil {
-		return RedisNoConnErr
+		if !redisReadOnly(key) {
+			return RedisNoConnErr
+		}
+
+		// degraded, no offline message
+		LogError(LogLevelWarn, "device:%s redis read-only, skip offline message", key)
+		return nil
 	}
 
 	defer rc.Close()
-	midStr := fmt.Sprintf("(%d", mid)
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	// check exceed the maxsubscribers
-	if len(c.conn)+1 > Conf.MaxSubscriberPerKey {
-		return MaxConnErr
-	}
-
-	LogError(LogLevelInfo, "add conn for device:%s", key)
-	// save the last push message id
-	c.conn[conn] = mid
-	reply, err := rc.Do("ZRANGEBYSCORE", msgRedisPre+key, midStr, -1)
-	if err != nil {
-		delete(c.conn, conn)
-		LogError(LogLevelErr, "redis(\"ZRANGEBYSCORE\", \"%s\", \"%s\", 1) failed (%s)", msgRedisPre+key, midStr, err.Error())
+	// resume from the acked message
+	acked, err := redis.Int64(rc.Do("GET", ackRedisPre+key))
+	if err != nil && err != redis.ErrNil {
+		LogError(LogLevelErr, "redis(\"GET\", \"%s\") failed (%s)", ackRedisPre+key, err.Error())
 		return err
 	}
 
-	msgs, err := redis.Strings(reply, nil)
-	if err != nil {
-		delete(c.conn, conn)
-		LogError(LogLevelErr, "redis.Strings() failed (%s)", err.Error())
-		return err
+	if acked > mid {
+		mid = acked
 	}
 
-	for _, msg := range msgs {
-		m, err := NewJsonStrMessage(msg)
-		if err != nil {
-			// drop the message, can't unmarshal
-			_, err := rc.Do("ZREM", msgRedisPre+key, m.MsgID)
-			if err != nil {
-				LogError(LogLevelErr, "redis(\"ZREM\", \"%s\", %d) failed (%s)", msgRedisPre+key, m.MsgID, err.Error())
+	return s.replay(rc, mid, key, f)
+}
+
+// replay call f with the offline messages greate than mid page by page
+// (ZRANGEBYSCORE LIMIT), the unmarshal failed and expired messages are
+// deleted with the next page fetching in one round trip (ZREM). The next
+// page starts at the last score inclusive, the members of it already seen
+// are skipped, so the messages of the same score not lost.
+func (s *RedisStore) replay(rc redis.Conn, mid int64, key string, f func(m *Message) error) error {
+	var (
+		dropped  []interface{}
+		score    int64
+		last     = mid
+		min      = fmt.Sprintf("(%d", mid)
+		count    int
+		msgs     []string
+		lastPage bool
+		// the members of the last score already seen
+		seen = map[string]bool{}
+	)
+
+	for !lastPage {
+		if len(dropped) > 0 {
+			if err := rc.Send("ZREM", append([]interface{}{msgRedisPre + key}, dropped...)...); err != nil {
+				return err
 			}
+		}
 
-			LogError(LogLevelErr, "device:%s: can't unmarshal message %s (%s)", key, msg, err.Error())
-			continue
+		count = redisReplayPage + len(seen)
+		if err := rc.Send("ZRANGEBYSCORE", msgRedisPre+key, min, "+inf", "WITHSCORES", "LIMIT", 0, count); err != nil {
+			return err
 		}
 
-		if m.Expired() {
-			// drop the message, expired
-			_, err := rc.Do("ZREM", msgRedisPre+key, m.MsgID)
-			if err != nil {
-				LogError(LogLevelErr, "redis(\"ZREM\", \"%s\", %d) failed (%s)", msgRedisPre+key, m.MsgID, err.Error())
+		if err := rc.Flush(); err != nil {
+			LogError(LogLevelErr, "redis Flush() failed (%s)", err.Error())
+			return err
+		}
+
+		if len(dropped) > 0 {
+			if _, err := rc.Receive(); err != nil {
+				LogError(LogLevelErr, "redis(\"ZREM\", \"%s\") %d messages failed (%s)", msgRedisPre+key, len(dropped), err.Error())
 			}
 
-			LogError(LogLevelWarn, "device:%s message %d expired", key, m.MsgID)
-			continue
+			dropped = nil
 		}
 
-		b, err := m.Bytes(buf)
-		if err != nil {
-			LogError(LogLevelErr, "message.Bytes(buf) failed (%s)", err.Error())
-			delete(c.conn, conn)
+		reply, err := rc.Receive()
+		if msgs, err = redis.Strings(reply, err); err != nil {
+			LogError(LogLevelErr, "redis(\"ZRANGEBYSCORE\", \"%s\", \"%s\", \"+inf\") failed (%s)", msgRedisPre+key, min, err.Error())
 			return err
 		}
 
-		if _, err = conn.Write(b); err != nil {
-			LogError(LogLevelErr, "message write error, m.Write() failed (%s)", err.Error())
-			delete(c.conn, conn)
-			return err
+		lastPage = len(msgs) < count*2
+		// member, score pairs
+		for i := 0; i+1 < len(msgs); i += 2 {
+			msg := msgs[i]
+			if score, err = strconv.ParseInt(msgs[i+1], 10, 64); err != nil {
+				LogError(LogLevelErr, "device:%s message score %s error (%s)", key, msgs[i+1], err.Error())
+				return RedisDataErr
+			}
+
+			if score != last {
+				last = score
+				seen = map[string]bool{}
+			} else if seen[msg] {
+				continue
+			}
+
+			seen[msg] = true
+
+			m, err := NewJsonStrMessage(msg)
+			if err != nil {
+				// drop the message, can't unmarshal
+				LogError(LogLevelErr, "device:%s: can't unmarshal message %s (%s)", key, msg, err.Error())
+				dropped = append(dropped, msg)
+				continue
+			}
+
+			if m.Expired() {
+				// drop the message, expired
+				LogError(LogLevelWarn, "device:%s message %d expired", key, m.MsgID)
+				dropped = append(dropped, msg)
+				continue
+			}
+
+			if err = f(m); err != nil {
+				return err
+			}
 		}
 
-		buf.Reset()
-		nmid = m.MsgID
-		LogError(LogLevelInfo, "push message \"%s\":%d to device:%s", m.Msg, m.MsgID, key)
+		min = fmt.Sprintf("[%d", last)
+	}
+
+	if len(dropped) > 0 {
+		if _, err := rc.Do("ZREM", append([]interface{}{msgRedisPre + key}, dropped...)...); err != nil {
+			LogError(LogLevelErr, "redis(\"ZREM\", \"%s\") %d messages failed (%s)", msgRedisPre+key, len(dropped), err.Error())
+		}
 	}
 
-	c.conn[conn] = nmid
 	return nil
 }
 
-// AddConn implements the Channel AddConn method.
-func (c *RedisChannel) AddConn(conn net.Conn, mid int64, key string) error {
+// ConnAdded implements the ConnObserver ConnAdded method.
+func (s *RedisStore) ConnAdded(key string) error {
 	// store the online state in redis hashes (HINCRBY)
 	rc := getRedisConn(key)
 	if rc == nil {
+		if redisReadOnly(key) {
+			// degraded, no online state
+			return nil
+		}
+
 		LogError(LogLevelWarn, "can't get a redis connection")
-		// drop the connection from map, RemoveConn won't call if err
-		c.mutex.Lock()
-		delete(c.conn, conn)
-		c.mutex.Unlock()
 		return RedisNoConnErr
 	}
 
 	defer rc.Close()
-	LogError(LogLevelInfo, "device:%s incr online number in %s", key, Conf.Node)
-	_, err := rc.Do("HINCRBY", onlineRedisPre+key, Conf.Node, 1)
+	LogError(LogLevelInfo, "device:%s incr online number in %s", key, Conf().Node)
+	_, err := rc.Do("HINCRBY", onlineRedisPre+key, Conf().Node, 1)
 	if err != nil {
-		// drop the connection from map, RemoveConn won't call if err
-		c.mutex.Lock()
-		delete(c.conn, conn)
-		c.mutex.Unlock()
-		LogError(LogLevelErr, "redis(\"HINCRBY\", \"%s\", \"%s\", 1) failed (%s)", onlineRedisPre+key, Conf.Node, err.Error())
+		LogError(LogLevelErr, "redis(\"HINCRBY\", \"%s\", \"%s\", 1) failed (%s)", onlineRedisPre+key, Conf().Node, err.Error())
 		return err
 	}
 
 	return nil
 }
 
-// RemoveConn implements the Channel RemoveConn method.
-func (c *RedisChannel) RemoveConn(conn net.Conn, mid int64, key string) error {
-	c.mutex.Lock()
-	LogError(LogLevelInfo, "remove conn for device:%s", key)
-	delete(c.conn, conn)
-	c.mutex.Unlock()
-
+// ConnRemoved implements the ConnObserver ConnRemoved method.
+func (s *RedisStore) ConnRemoved(key string) error {
 	// remove the online state in redis hashes (HINCRBY)
 	rc := getRedisConn(key)
 	if rc == nil {
@@ -260,19 +383,19 @@ func (c *RedisChannel) RemoveConn(conn net.Conn, mid int64, key string) error {
 	}
 
 	defer rc.Close()
-	LogError(LogLevelInfo, "device:%s decr online number in %s", key, Conf.Node)
-	_, err := rc.Do("HINCRBY", onlineRedisPre+key, Conf.Node, -1)
+	LogError(LogLevelInfo, "device:%s decr online number in %s", key, Conf().Node)
+	_, err := rc.Do("HINCRBY", onlineRedisPre+key, Conf().Node, -1)
 	if err != nil {
-		LogError(LogLevelErr, "redis(\"HINCRBY\", \"%s\", \"%s\", -1) failed (%s)", onlineRedisPre+key, Conf.Node, err.Error())
+		LogError(LogLevelErr, "redis(\"HINCRBY\", \"%s\", \"%s\", -1) failed (%s)", onlineRedisPre+key, Conf().Node, err.Error())
 		return err
 	}
 
 	return nil
 }
 
-// AddToken implements the Channel AddToken method.
-func (c *RedisChannel) AddToken(token string, key string) error {
-	// store the token in redis sets (SADD)
+// AddToken implements the TokenStore AddToken method.
+func (s *RedisStore) AddToken(token string, key string) error {
+	// store the token in redis sets (SADD, PEXPIRE)
 	conn := getRedisConn(key)
 	if conn == nil {
 		LogError(LogLevelWarn, "can't get a redis connection")
@@ -280,13 +403,17 @@ func (c *RedisChannel) AddToken(token string, key string) error {
 	}
 
 	defer conn.Close()
-	reply, err := conn.Do("SADD", tokenRedisPre+key, token)
+	// the tokens expired with the channel, refreshed by every added one
+	conn.Send("MULTI")
+	conn.Send("SADD", tokenRedisPre+key, token)
+	conn.Send("PEXPIRE", tokenRedisPre+key, redisKeyTTL())
+	reply, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		LogError(LogLevelErr, "redis(\"SADD\", \"%s\", \"%s\") failed (%s)", tokenRedisPre+key, token, err.Error())
 		return err
 	}
 
-	r, err := redis.Int(reply, nil)
+	r, err := redis.Int(reply[0], nil)
 	if err != nil {
 		LogError(LogLevelErr, "redis.Int() failed (%s)", err.Error())
 		return err
@@ -300,8 +427,8 @@ func (c *RedisChannel) AddToken(token string, key string) error {
 	return nil
 }
 
-// AuthToken implements the Channel AuthToken method.
-func (c *RedisChannel) AuthToken(token string, key string) error {
+// AuthToken implements the TokenStore AuthToken method.
+func (s *RedisStore) AuthToken(token string, key string) error {
 	// remove the token from redis sets (SREM)
 	conn := getRedisConn(key)
 	if conn == nil {
@@ -324,46 +451,92 @@ func (c *RedisChannel) AuthToken(token string, key string) error {
 
 	if r == 0 {
 		LogError(LogLevelWarn, "device:%s token %s not exist, auth failed", key, token)
+		chStat.IncrAuthFailed()
 		return AuthTokenErr
 	}
 
 	return nil
 }
 
-// SetDeadline implements the Channel SetDeadline method.
-func (c *RedisChannel) SetDeadline(d int64) {
-	c.expire = d
-}
+// Ack implements the MessageStore Ack method.
+func (s *RedisStore) Ack(mid int64, key string) error {
+	// store the acked message id in redis (GET, SET, PEXPIRE by lua script)
+	rc := getRedisConn(key)
+	if rc == nil {
+		LogError(LogLevelWarn, "can't get a redis connection")
+		return RedisNoConnErr
+	}
 
-// Timeout implements the Channel Timeout method.
-func (c *RedisChannel) Timeout() bool {
-	return time.Now().UnixNano() > c.expire
+	defer rc.Close()
+	if _, err := ackScript.Do(rc, ackRedisPre+key, msgRedisPre+key, mid, redisKeyTTL()); err != nil {
+		LogError(LogLevelErr, "redis ack script(\"%s\", %d) failed (%s)", ackRedisPre+key, mid, err.Error())
+		return err
+	}
+
+	return nil
 }
 
-// Close implements the Channel Close method.
-func (c *RedisChannel) Close() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// AckStat implements the MessageStore AckStat method.
+func (s *RedisStore) AckStat(key string) (*AckStat, error) {
+	rc := getRedisConn(key)
+	if rc == nil {
+		LogError(LogLevelWarn, "can't get a redis connection")
+		return nil, RedisNoConnErr
+	}
 
-	for conn, _ := range c.conn {
-		if err := conn.Close(); err != nil {
-			// ignore close error
-			LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
-		}
+	defer rc.Close()
+	acked, err := redis.Int64(rc.Do("GET", ackRedisPre+key))
+	if err != nil && err != redis.ErrNil {
+		LogError(LogLevelErr, "redis(\"GET\", \"%s\") failed (%s)", ackRedisPre+key, err.Error())
+		return nil, err
 	}
 
+	midStr := fmt.Sprintf("(%d", acked)
+	unacked, err := redis.Int(rc.Do("ZCOUNT", msgRedisPre+key, midStr, "+inf"))
+	if err != nil {
+		LogError(LogLevelErr, "redis(\"ZCOUNT\", \"%s\", \"%s\", \"+inf\") failed (%s)", msgRedisPre+key, midStr, err.Error())
+		return nil, err
+	}
+
+	return &AckStat{Acked: acked, Unacked: unacked}, nil
+}
+
+// Purge implements the MessageStore Purge method.
+func (s *RedisStore) Purge(key string) int {
+	// the messages stored in redis, score is message id not the expire time,
+	// expired messages are deleted in SendMsg
+	return 0
+}
+
+// Close implements the MessageStore Close method.
+func (s *RedisStore) Close(key string) error {
+	// the messages expired by redis with the message expire time, the
+	// tokens, acked id and id counter with the Conf().ChannelExpireSec
+	// refreshed on write
 	return nil
 }
 
+// redisKeyTTL get the ttl millisecond of the tokens, acked id and id counter
+// keys of a channel
+func redisKeyTTL() int64 {
+	return Conf().ChannelExpireSec * int64(time.Second/time.Millisecond)
+}
+
+// getRedisNode get the redis node name of the key
+func getRedisNode(key string) string {
+	return redisHash.Node(key)
+}
+
 func getRedisConn(key string) redis.Conn {
-	node := defaultRedisNode
-	// if multiple redispool use ketama
-	if len(redisPool) != 1 {
-		node = redisHash.Node(key)
+	node := getRedisNode(key)
+	// fail fast, not wait the dial timeout
+	if !redisHealth.Alive(node) {
+		LogError(LogLevelWarn, "key:%s redis node:%s dead", key, node)
+		return nil
 	}
 
-	p, ok := redisPool[node]
-	if !ok {
+	p := getRedisPool(node)
+	if p == nil {
 		LogError(LogLevelWarn, "no exists key:%s in redisPool map", key)
 		return nil
 	}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redisTestConn is a redis conn of one sorted set, only ZRANGEBYSCORE
+// WITHSCORES LIMIT and ZREM
+type redisTestConn struct {
+	members map[string]int64
+	replies []interface{}
+}
+
+func (c *redisTestConn) Close() error { return nil }
+func (c *redisTestConn) Err() error   { return nil }
+func (c *redisTestConn) Flush() error { return nil }
+
+func (c *redisTestConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+
+	var reply interface{}
+	for len(c.replies) > 0 {
+		reply, _ = c.Receive()
+	}
+
+	return reply, nil
+}
+
+func (c *redisTestConn) Send(cmd string, args ...interface{}) error {
+	switch cmd {
+	case "ZREM":
+		for _, m := range args[1:] {
+			delete(c.members, m.(string))
+		}
+
+		c.replies = append(c.replies, int64(len(args)-1))
+	case "ZRANGEBYSCORE":
+		min := args[1].(string)
+		score, _ := strconv.ParseInt(strings.TrimLeft(min, "(["), 10, 64)
+		members := []string{}
+		for m, s := range c.members {
+			if s > score || (s == score && min[0] == '[') {
+				members = append(members, m)
+			}
+		}
+
+		// by score then member, like redis
+		sort.Slice(members, func(i, j int) bool {
+			if c.members[members[i]] != c.members[members[j]] {
+				return c.members[members[i]] < c.members[members[j]]
+			}
+
+			return members[i] < members[j]
+		})
+
+		count := args[6].(int)
+		if len(members) > count {
+			members = members[:count]
+		}
+
+		reply := []interface{}{}
+		for _, m := range members {
+			reply = append(reply, []byte(m), []byte(strconv.FormatInt(c.members[m], 10)))
+		}
+
+		c.replies = append(c.replies, reply)
+	default:
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+
+	return nil
+}
+
+func (c *redisTestConn) Receive() (interface{}, error) {
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply, nil
+}
+
+func TestRedisReplaySameScore(t *testing.T) {
+	SetConf(&Config{})
+	expire := time.Now().UnixNano() + 60*Second
+	c := &redisTestConn{members: map[string]int64{}}
+	// the supplied message ids may be duplicated, a page of the same score
+	want := []int64{}
+	for i := 0; i < redisReplayPage+10; i++ {
+		mid := int64(1)
+		if i > redisReplayPage/2 {
+			mid = int64(2 + i/3)
+		}
+
+		c.members[fmt.Sprintf(`{"msg":"test%d","expire":%d,"mid":%d}`, i, expire, mid)] = mid
+		want = append(want, mid)
+	}
+
+	// expired message dropped
+	c.members[fmt.Sprintf(`{"msg":"expired","expire":1,"mid":%d}`, 1)] = 1
+	got := []int64{}
+	err := redisStore.replay(c, 0, "Terry-Mao", func(m *Message) error {
+		got = append(got, m.MsgID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("replayed messages must be %d, but %d", len(want), len(got))
+	}
+
+	for i, mid := range got {
+		if i > 0 && mid < got[i-1] {
+			t.Errorf("replayed messages must be in order, but %v", got)
+			break
+		}
+	}
+
+	if len(c.members) != len(want) {
+		t.Errorf("expired message must be removed, but %d members", len(c.members))
+	}
+}
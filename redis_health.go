@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+const (
+	// eject the dead shard from the ring, the keys fall back to the next
+	// node on the ring
+	RedisFallbackNext = 0
+	// keep the ring, the keys of the dead shard fail fast, the subscribers
+	// still can connect but no offline message and publishing
+	RedisFallbackReadOnly = 1
+	// the consecutive PING failures before mark the shard dead
+	redisDeadFails = 2
+)
+
+var (
+	// the health of every redis shard
+	redisHealth = &RedisHealth{mutex: &sync.RWMutex{}, shards: map[string]*RedisShardStat{}}
+)
+
+// RedisShardStat is the health of a redis shard.
+type RedisShardStat struct {
+	// Alive or not
+	Alive bool `json:"alive"`
+	// Ejected from the ring
+	Ejected bool `json:"ejected"`
+	// Consecutive PING failures
+	Fails int `json:"fails"`
+	// Times marked dead
+	Dead uint64 `json:"dead"`
+	// Last checked unixnano
+	LastCheck int64 `json:"last_check"`
+	// Last PING error
+	LastErr string `json:"last_err"`
+}
+
+// RedisHealth PING every redis shard each Conf().RedisCheckSec, the dead
+// shards are ejected from the ring or read-only by Conf().RedisFallback, and
+// re-admitted once PING succeed.
+type RedisHealth struct {
+	mutex  *sync.RWMutex
+	shards map[string]*RedisShardStat
+}
+
+// StartRedisHealthCheck start the health check goroutine
+func StartRedisHealthCheck() {
+	redisHealth.mutex.Lock()
+	for _, node := range redisNodes() {
+		redisHealth.shards[node] = &RedisShardStat{Alive: true}
+	}
+	redisHealth.mutex.Unlock()
+	go func() {
+		for {
+			time.Sleep(time.Duration(Conf().RedisCheckSec) * time.Second)
+			redisHealth.check()
+		}
+	}()
+}
+
+// check PING all the shards concurrently, a hung shard can't delay the
+// others. The subscribed keys are moved if the ring changed.
+func (h *RedisHealth) check() {
+	wg := &sync.WaitGroup{}
+	changed := make(chan bool, len(Conf().Redis))
+	for node, c := range Conf().Redis {
+		wg.Add(1)
+		go func(node string, c *RedisConfig) {
+			defer wg.Done()
+			changed <- h.update(node, redisPing(c))
+		}(node, c)
+	}
+
+	wg.Wait()
+	close(changed)
+	resub := false
+	for ok := range changed {
+		resub = resub || ok
+	}
+
+	if resub {
+		redisResubscribe()
+	}
+}
+
+// redisPing PING the shard by a dedicated conn with Conf().RedisCheckSec
+// timeout, not the pooled conns which may block on a hung shard
+func redisPing(c *RedisConfig) error {
+	timeout := time.Duration(Conf().RedisCheckSec) * time.Second
+	conn, err := redis.DialTimeout(c.Network, c.Addr, timeout, timeout, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
+
+// update mark the shard dead after redisDeadFails failures, alive after a
+// success, return true if the shard ejected from or re-admitted to the ring
+func (h *RedisHealth) update(node string, err error) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.shards[node]
+	if !ok {
+		return false
+	}
+
+	s.LastCheck = time.Now().UnixNano()
+	if err == nil {
+		s.Fails = 0
+		s.LastErr = ""
+		if !s.Alive {
+			LogError(LogLevelInfo, "redis node:%s alive again", node)
+			s.Alive = true
+		}
+
+		if s.Ejected {
+			LogError(LogLevelInfo, "redis node:%s re-admitted to the ring", node)
+			redisHash.AddNode(node, Conf().Redis[node].Weight)
+			s.Ejected = false
+			return true
+		}
+
+		return false
+	}
+
+	s.Fails++
+	s.LastErr = err.Error()
+	LogError(LogLevelErr, "redis node:%s PING failed %d times (%s)", node, s.Fails, err.Error())
+	if !s.Alive || s.Fails < redisDeadFails {
+		return false
+	}
+
+	LogError(LogLevelErr, "redis node:%s dead", node)
+	s.Alive = false
+	s.Dead++
+	if Conf().RedisFallback == RedisFallbackNext {
+		LogError(LogLevelWarn, "redis node:%s ejected from the ring, keys fall back to the next node", node)
+		redisHash.RemoveNode(node)
+		s.Ejected = true
+		return true
+	}
+
+	return false
+}
+
+// Alive check the shard alive or not
+func (h *RedisHealth) Alive(node string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if s, ok := h.shards[node]; ok {
+		return s.Alive
+	}
+
+	return true
+}
+
+// redisReadOnly check the key's shard dead in the read-only fallback mode
+func redisReadOnly(key string) bool {
+	return Conf().RedisFallback == RedisFallbackReadOnly && !redisHealth.Alive(getRedisNode(key))
+}
+
+// Stats get the health of every shard
+func (h *RedisHealth) Stats() []byte {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := map[string]interface{}{}
+	for node, s := range h.shards {
+		stat := *s
+		res[node] = &stat
+	}
+
+	return jsonRes(res)
+}
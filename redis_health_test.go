@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"github.com/Terry-Mao/gopush2/hash"
+	"sync"
+	"testing"
+)
+
+func TestRedisHealth(t *testing.T) {
+	SetConf(&Config{RedisFallback: RedisFallbackNext, Redis: map[string]*RedisConfig{"redis-a": &RedisConfig{Weight: 1}, "redis-b": &RedisConfig{Weight: 1}}})
+	redisHash = hash.NewKetamaNodes(map[string]int{"redis-a": 1, "redis-b": 1}, redisVNode)
+	h := &RedisHealth{mutex: &sync.RWMutex{}, shards: map[string]*RedisShardStat{"redis-a": &RedisShardStat{Alive: true}, "redis-b": &RedisShardStat{Alive: true}}}
+	err := errors.New("connection refused")
+	h.update("redis-a", err)
+	if !h.Alive("redis-a") {
+		t.Error("redis-a must be alive after one failure")
+	}
+
+	h.update("redis-a", err)
+	if h.Alive("redis-a") {
+		t.Error("redis-a must be dead")
+	}
+
+	for _, key := range []string{"Terry-Mao", "Terry-Mao1", "Terry-Mao2", "Terry-Mao3"} {
+		if n := redisHash.Node(key); n != "redis-b" {
+			t.Errorf("%s must fall back to redis-b, but %s", key, n)
+		}
+	}
+
+	h.update("redis-a", nil)
+	if !h.Alive("redis-a") || len(redisHash.Nodes()) != 2 {
+		t.Error("redis-a must be re-admitted")
+	}
+}
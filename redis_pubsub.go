@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pubsubRedisPre = "p_"
+	// resubscribe delay after the subscriber conn broken
+	redisResubscribeDelay = time.Second
+)
+
+var (
+	redisSubscribers = map[string]*redisSubscriber{}
+)
+
+// redisSubscriber subscribe the keys which have local conns in a redis node,
+// the messages published by any gopush2 node are delivered to the local
+// conns.
+type redisSubscriber struct {
+	// Redis node name
+	node string
+	// Mutex
+	mutex *sync.Mutex
+	// Subscribed keys, the value is the local conn number
+	keys map[string]int
+	// Subscriber conn, nil if disconnected
+	conn *redis.PubSubConn
+}
+
+// InitRedisSubscriber start a subscriber for every redis node
+func InitRedisSubscriber() {
+	for _, node := range redisNodes() {
+		s := &redisSubscriber{node: node, mutex: &sync.Mutex{}, keys: map[string]int{}}
+		redisSubscribers[node] = s
+		go s.run()
+	}
+}
+
+// redisSubscribe subscribe the key in the redis node of the key
+func redisSubscribe(key string) {
+	if s, ok := redisSubscribers[getRedisNode(key)]; ok {
+		s.Subscribe(key)
+	}
+}
+
+// redisUnsubscribe unsubscribe the key in the redis node of the key, the
+// node of the key may change after a shard ejected or re-admitted, so try
+// the others if not subscribed in it
+func redisUnsubscribe(key string) {
+	node := getRedisNode(key)
+	if s, ok := redisSubscribers[node]; ok && s.Unsubscribe(key) {
+		return
+	}
+
+	for n, s := range redisSubscribers {
+		if n != node && s.Unsubscribe(key) {
+			return
+		}
+	}
+}
+
+// redisResubscribe move the subscribed keys to the subscriber of their new
+// node after the ring changed, so the messages published to the new node
+// are still delivered to the local conns
+func redisResubscribe() {
+	for node, s := range redisSubscribers {
+		moved := s.take(func(key string) bool { return getRedisNode(key) != node })
+		for key, n := range moved {
+			if t, ok := redisSubscribers[getRedisNode(key)]; ok {
+				LogError(LogLevelInfo, "device:%s resubscribe from redis node:%s to %s", key, node, t.node)
+				t.add(key, n)
+			}
+		}
+	}
+}
+
+// Subscribe add a local conn of the key, subscribe the key if it's the first
+// one. If disconnected, the key will be subscribed after reconnected.
+func (s *redisSubscriber) Subscribe(key string) {
+	s.add(key, 1)
+}
+
+// add add n local conns of the key, subscribe the key if it's not subscribed
+func (s *redisSubscriber) add(key string, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old := s.keys[key]
+	s.keys[key] += n
+	if old > 0 || s.conn == nil {
+		return
+	}
+
+	if err := s.conn.Subscribe(pubsubRedisPre + key); err != nil {
+		// the receive loop will get the error and resubscribe
+		LogError(LogLevelErr, "redis(\"SUBSCRIBE\", \"%s\") failed (%s)", pubsubRedisPre+key, err.Error())
+	}
+}
+
+// Unsubscribe remove a local conn of the key, unsubscribe the key if it's the
+// last one. Return false if the key not subscribed.
+func (s *redisSubscriber) Unsubscribe(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		return false
+	}
+
+	if s.keys[key]--; s.keys[key] > 0 {
+		return true
+	}
+
+	delete(s.keys, key)
+	if s.conn == nil {
+		return true
+	}
+
+	if err := s.conn.Unsubscribe(pubsubRedisPre + key); err != nil {
+		LogError(LogLevelErr, "redis(\"UNSUBSCRIBE\", \"%s\") failed (%s)", pubsubRedisPre+key, err.Error())
+	}
+
+	return true
+}
+
+// take remove the keys matched by f and unsubscribe them, return the keys
+// with their local conn number
+func (s *redisSubscriber) take(f func(key string) bool) map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := map[string]int{}
+	channels := []interface{}{}
+	for key, n := range s.keys {
+		if f(key) {
+			keys[key] = n
+			channels = append(channels, pubsubRedisPre+key)
+			delete(s.keys, key)
+		}
+	}
+
+	if len(channels) == 0 || s.conn == nil {
+		return keys
+	}
+
+	if err := s.conn.Unsubscribe(channels...); err != nil {
+		LogError(LogLevelErr, "redis node:%s UNSUBSCRIBE %d keys failed (%s)", s.node, len(channels), err.Error())
+	}
+
+	return keys
+}
+
+// run receive the published messages, resubscribe all the keys if the conn
+// broken
+func (s *redisSubscriber) run() {
+	for {
+		if err := s.serve(); err != nil {
+			LogError(LogLevelErr, "redis node:%s subscriber failed (%s), resubscribe after %s", s.node, err.Error(), redisResubscribeDelay)
+		}
+
+		time.Sleep(redisResubscribeDelay)
+	}
+}
+
+func (s *redisSubscriber) serve() error {
+	p := getRedisPool(s.node)
+	if p == nil {
+		return RedisNoConnErr
+	}
+
+	// not a pooled conn, the subscriber conn can't be reused
+	rc, err := p.Dial()
+	if err != nil {
+		return err
+	}
+
+	conn := &redis.PubSubConn{Conn: rc}
+	defer conn.Close()
+	s.mutex.Lock()
+	if len(s.keys) > 0 {
+		channels := make([]interface{}, 0, len(s.keys))
+		for key, _ := range s.keys {
+			channels = append(channels, pubsubRedisPre+key)
+		}
+
+		if err = conn.Subscribe(channels...); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+
+	s.conn = conn
+	s.mutex.Unlock()
+	LogError(LogLevelInfo, "redis node:%s subscriber start", s.node)
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			s.deliver(strings.TrimPrefix(v.Channel, pubsubRedisPre), v.Data)
+		case redis.Subscription:
+			LogError(LogLevelDebug, "redis node:%s %s \"%s\" (%d)", s.node, v.Kind, v.Channel, v.Count)
+		case error:
+			s.mutex.Lock()
+			s.conn = nil
+			s.mutex.Unlock()
+			return v
+		}
+	}
+}
+
+// deliver push the published message to the local conns of the key
+func (s *redisSubscriber) deliver(key string, data []byte) {
+	c, err := channel.Get(key)
+	if err != nil {
+		LogError(LogLevelDebug, "device:%s no local channel (%s)", key, err.Error())
+		return
+	}
+
+	sc, ok := c.(*StoreChannel)
+	if !ok {
+		LogError(LogLevelErr, "device:%s channel assert type failed", key)
+		return
+	}
+
+	m, err := NewJsonStrMessage(string(data))
+	if err != nil {
+		// drop the message, can't unmarshal
+		LogError(LogLevelErr, "device:%s can't unmarshal the published message %s (%s)", key, string(data), err.Error())
+		return
+	}
+
+	sc.Push(m, key)
+}
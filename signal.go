@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// max wait second for the conn handle routines exit
+	shutdownWaitSec = 10
+	// reconnect control frame, tell client reconnect to another node
+	reconnectMsg = "r"
+)
+
+var (
+	// reconnect bytes
+	reconnectBytes = []byte(reconnectMsg)
+	// 1 if shutdown
+	shutdownFlag int32
+	// listeners closed when shutdown
+	listeners     = []net.Listener{}
+	listenerMutex = &sync.Mutex{}
+)
+
+// InitSignal register signals handler.
+func InitSignal() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	return c
+}
+
+// HandleSignal blocking wait the signals, return after shutdown.
+func HandleSignal(c chan os.Signal) {
+	for {
+		s := <-c
+		LogError(LogLevelInfo, "get a signal %s", s.String())
+		switch s {
+		case syscall.SIGHUP:
+			if _, _, err := ReloadConfig(); err != nil {
+				LogError(LogLevelErr, "ReloadConfig() failed (%s)", err.Error())
+			}
+		case syscall.SIGTERM, syscall.SIGINT:
+			Shutdown()
+			return
+		default:
+			return
+		}
+	}
+}
+
+// addListener register the listener, closed when shutdown.
+func addListener(l net.Listener) {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	listeners = append(listeners, l)
+}
+
+// isShutdown check the server is shutting down or not.
+func isShutdown() bool {
+	return atomic.LoadInt32(&shutdownFlag) == 1
+}
+
+// Shutdown stop accepting on all the listeners, tell subscribers reconnect
+// elsewhere, wait the drain period then close all the subscriber conns.
+func Shutdown() {
+	LogError(LogLevelInfo, "gopush2 shutdown start, %d conns", subConns.Len())
+	atomic.StoreInt32(&shutdownFlag, 1)
+	// stop accepting
+	listenerMutex.Lock()
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			LogError(LogLevelErr, "listener.Close() failed (%s)", err.Error())
+		}
+	}
+
+	listenerMutex.Unlock()
+	// stop routing keys to this node
+	nodes.Unregister()
+	// tell subscribers reconnect elsewhere
+	if Conf().ShutdownReconnect == 1 {
+		subConns.Range(func(conn net.Conn) {
+			if _, err := conn.Write(reconnectBytes); err != nil {
+				LogError(LogLevelErr, "conn.Write() failed, write reconnect to client (%s)", err.Error())
+			}
+		})
+	}
+
+	// drain, the clients close the conns themselves
+	end := time.Now().Add(time.Duration(Conf().ShutdownDrainSec) * time.Second)
+	for subConns.Len() > 0 && time.Now().Before(end) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// close the remain conns, the handle routines will call RemoveConn
+	subConns.Range(func(conn net.Conn) {
+		if err := conn.Close(); err != nil {
+			LogError(LogLevelErr, "conn.Close() failed (%s)", err.Error())
+		}
+	})
+
+	if !subConns.Wait(shutdownWaitSec * time.Second) {
+		LogError(LogLevelWarn, "wait conns removed timedout, %d conns left", subConns.Len())
+	}
+
+	// save the inner channels after the last acks
+	if Conf().ChannelType == InnerChannelType && Conf().SnapshotFile != "" && channel != nil {
+		SaveSnapshot(channel, Conf().SnapshotFile)
+	}
+
+	LogError(LogLevelInfo, "gopush2 shutdown end")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotMagic   = "GPS2"
+	snapshotVersion = uint16(1)
+	// magic + version
+	snapshotHeaderSize = 6
+	// a string can't be larger than this, or the snapshot broken
+	snapshotMaxString = 16 * 1024 * 1024
+)
+
+var (
+	// Snapshot magic, size or crc32 error
+	SnapshotBrokenErr = errors.New("Snapshot broken")
+	// Snapshot written by a unknown version
+	SnapshotVersionErr = errors.New("Snapshot version not support")
+	// serialize the snapshot writers
+	snapshotMutex = &sync.Mutex{}
+)
+
+// The snapshot format, all the integers are big endian:
+// | magic "GPS2" | version uint16 | channels uint32 | channel... | crc32 uint32 |
+// channel: | key string | expire int64 | last mid int64 | acked int64 |
+//          | tokens uvarint | token string... | messages uvarint | message... |
+// message: | mid int64 | expire int64 | msg string |
+// string: | length uvarint | bytes |
+// crc32 is the IEEE checksum of all the bytes before it.
+
+// snapshotEncoder write the snapshot fields, keep the first error
+type snapshotEncoder struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *snapshotEncoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *snapshotEncoder) int64(i int64) {
+	binary.BigEndian.PutUint64(e.buf[:8], uint64(i))
+	e.write(e.buf[:8])
+}
+
+func (e *snapshotEncoder) uvarint(i uint64) {
+	n := binary.PutUvarint(e.buf[:], i)
+	e.write(e.buf[:n])
+}
+
+func (e *snapshotEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+// snapshotDecoder read the snapshot fields, keep the first error
+type snapshotDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *snapshotDecoder) int64() int64 {
+	if d.err != nil || len(d.b) < 8 {
+		d.err = SnapshotBrokenErr
+		return 0
+	}
+
+	i := int64(binary.BigEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return i
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	i, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = SnapshotBrokenErr
+		return 0
+	}
+
+	d.b = d.b[n:]
+	return i
+}
+
+func (d *snapshotDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || n > snapshotMaxString || uint64(len(d.b)) < n {
+		d.err = SnapshotBrokenErr
+		return ""
+	}
+
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// StartSnapshot start a goroutine save the inner channels snapshot every
+// Conf().SnapshotSec seconds.
+func StartSnapshot() {
+	if Conf().ChannelType != InnerChannelType || Conf().SnapshotFile == "" {
+		return
+	}
+
+	if Conf().SnapshotSec <= 0 {
+		LogError(LogLevelWarn, "periodic snapshot disabled, only saved on shutdown")
+		return
+	}
+
+	go func() {
+		for !isShutdown() {
+			time.Sleep(time.Duration(Conf().SnapshotSec) * time.Second)
+			if !isShutdown() {
+				SaveSnapshot(channel, Conf().SnapshotFile)
+			}
+		}
+	}()
+}
+
+// SaveSnapshot write all the unexpired inner channels to the file, the file
+// is written to a temporary file then renamed, so a crash leaves either the
+// old or the new one.
+func SaveSnapshot(l *ChannelList, file string) error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	begin := time.Now()
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		LogError(LogLevelErr, "os.OpenFile(\"%s\") failed (%s)", tmp, err.Error())
+		return err
+	}
+
+	// the channel number is unknown until ranged, so encode the channels
+	// first
+	n := uint32(0)
+	body := &snapshotBuffer{}
+	e := &snapshotEncoder{w: body}
+	l.Range(func(key string, c Channel) {
+		sc, ok := c.(*StoreChannel)
+		if !ok {
+			return
+		}
+
+		// the file store persisted itself
+		if s, ok := sc.store.(*InnerStore); ok {
+			s.snapshot(e, key, sc.expire)
+			n++
+		}
+	})
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(f)
+	e = &snapshotEncoder{w: io.MultiWriter(bw, crc)}
+	e.write([]byte(snapshotMagic))
+	binary.BigEndian.PutUint16(e.buf[:2], snapshotVersion)
+	e.write(e.buf[:2])
+	binary.BigEndian.PutUint32(e.buf[:4], n)
+	e.write(e.buf[:4])
+	e.write(body.b)
+	binary.BigEndian.PutUint32(e.buf[:4], crc.Sum32())
+	e.w = bw
+	e.write(e.buf[:4])
+	if err = e.err; err == nil {
+		err = bw.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+
+	if err != nil {
+		LogError(LogLevelErr, "save snapshot \"%s\" failed (%s)", file, err.Error())
+		os.Remove(tmp)
+		return err
+	}
+
+	LogError(LogLevelInfo, "save snapshot \"%s\" %d channels in %s", file, n, time.Now().Sub(begin).String())
+	return nil
+}
+
+// snapshotBuffer is a growing byte slice writer
+type snapshotBuffer struct {
+	b []byte
+}
+
+func (b *snapshotBuffer) Write(p []byte) (int, error) {
+	b.b = append(b.b, p...)
+	return len(p), nil
+}
+
+// LoadSnapshot read the file and restore the unexpired inner channels and
+// messages to the channel list. A missing file is not a error.
+func LoadSnapshot(l *ChannelList, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		LogError(LogLevelErr, "ioutil.ReadFile(\"%s\") failed (%s)", file, err.Error())
+		return err
+	}
+
+	if len(b) < snapshotHeaderSize+8 || string(b[:4]) != snapshotMagic {
+		return SnapshotBrokenErr
+	}
+
+	if v := binary.BigEndian.Uint16(b[4:snapshotHeaderSize]); v != snapshotVersion {
+		LogError(LogLevelErr, "snapshot \"%s\" version %d not support", file, v)
+		return SnapshotVersionErr
+	}
+
+	end := len(b) - 4
+	if crc32.ChecksumIEEE(b[:end]) != binary.BigEndian.Uint32(b[end:]) {
+		return SnapshotBrokenErr
+	}
+
+	n := binary.BigEndian.Uint32(b[snapshotHeaderSize:])
+	d := &snapshotDecoder{b: b[snapshotHeaderSize+4 : end]}
+	chs := make(map[string]*StoreChannel, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		key, c := restoreInnerStore(d)
+		if c != nil {
+			chs[key] = c
+		}
+	}
+
+	if d.err != nil || len(d.b) != 0 {
+		return SnapshotBrokenErr
+	}
+
+	// restore all or nothing
+	for key, c := range chs {
+		l.put(key, c)
+	}
+
+	LogError(LogLevelInfo, "load snapshot \"%s\" %d channels, %d unexpired", file, n, len(chs))
+	return nil
+}
+
+// snapshot encode the store and the channel expire time
+func (s *InnerStore) snapshot(e *snapshotEncoder, key string, expire int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.string(key)
+	e.int64(expire)
+	e.int64(s.lastMsgID)
+	e.int64(s.acked)
+	e.uvarint(uint64(len(s.token)))
+	for token, _ := range s.token {
+		e.string(token)
+	}
+
+	e.uvarint(uint64(s.message.Length))
+	for n := s.message.Head.Next(); n != nil; n = n.Next() {
+		m, ok := n.Member.(*Message)
+		if !ok {
+			// never happen
+			panic(AssertTypeErr)
+		}
+
+		e.int64(m.MsgID)
+		e.int64(m.Expire)
+		e.string(m.Msg)
+	}
+}
+
+// restoreInnerStore decode a inner store channel, the channel is nil if
+// expired
+func restoreInnerStore(d *snapshotDecoder) (string, *StoreChannel) {
+	s := NewInnerStore()
+	key := d.string()
+	expire := d.int64()
+	s.lastMsgID = d.int64()
+	s.acked = d.int64()
+	tokens := d.uvarint()
+	for i := uint64(0); i < tokens && d.err == nil; i++ {
+		s.token[d.string()] = true
+	}
+
+	msgs := d.uvarint()
+	for i := uint64(0); i < msgs && d.err == nil; i++ {
+		m := &Message{}
+		m.MsgID = d.int64()
+		m.Expire = d.int64()
+		m.Msg = d.string()
+		if d.err != nil || m.Expired() || m.Encode() != nil {
+			continue
+		}
+
+		if s.message.Length+1 > s.MaxMessage {
+			s.message.Delete(s.message.Head.Next().Score)
+		}
+
+		s.message.Insert(m.MsgID, m)
+	}
+
+	sc := NewStoreChannel(key, s, s)
+	sc.SetDeadline(expire)
+	if sc.Timeout() {
+		return key, nil
+	}
+
+	return key, sc
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopush2.snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	defer os.Remove(f.Name())
+	SetConf(&Config{MaxStoredMessage: 20, ChannelExpireSec: 60, ChannelBucket: 16, ChannelType: InnerChannelType})
+	l := NewChannelList()
+	c, err := l.New("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expire := time.Now().UnixNano() + 60*Second
+	for i := 0; i < 3; i++ {
+		if err = c.PushMsg(&Message{Msg: "test", Expire: expire}, "Terry-Mao"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = c.Ack(1, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if err = c.AddToken("t1", "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if err = SaveSnapshot(l, f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	l = NewChannelList()
+	if err = LoadSnapshot(l, f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err = l.Get("Terry-Mao"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.AckStat("Terry-Mao")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Acked != 1 || s.Unacked != 2 {
+		t.Errorf("acked must be 1 and unacked must be 2, but %d, %d", s.Acked, s.Unacked)
+	}
+
+	if err = c.AuthToken("t1", "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	m := &Message{Msg: "test", Expire: expire}
+	if err = c.PushMsg(m, "Terry-Mao"); err != nil {
+		t.Error(err)
+	}
+
+	if m.MsgID != 4 {
+		t.Errorf("message id must be 4, but %d", m.MsgID)
+	}
+
+	// corrupt a byte
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[len(b)/2] ^= 0xff
+	if err = ioutil.WriteFile(f.Name(), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = LoadSnapshot(NewChannelList(), f.Name()); err != SnapshotBrokenErr {
+		t.Errorf("load a corrupt snapshot must be SnapshotBrokenErr, but %v", err)
+	}
+}
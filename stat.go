@@ -6,14 +6,149 @@ import (
 	"os"
 	"os/user"
 	"runtime"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// server
 	startTime int64 // process start unixnano
+	// channel
+	chStat = &ChannelStats{}
+	// conn
+	connStat = &ConnStats{}
 )
 
+// ConnStats is the conn statistics
+type ConnStats struct {
+	NodeRejected uint64 // rejected number by max conn of node
+	IPRejected   uint64 // rejected number by max conn per ip
+	QueueFull    uint64 // write queue full number
+	QueueDropped uint64 // frame dropped number by write queue full
+	SlowConn     uint64 // slow conn disconnected number by write queue full
+}
+
+// IncrNodeRejected increment the rejected number by max conn of node
+func (s *ConnStats) IncrNodeRejected() {
+	atomic.AddUint64(&s.NodeRejected, 1)
+}
+
+// IncrIPRejected increment the rejected number by max conn per ip
+func (s *ConnStats) IncrIPRejected() {
+	atomic.AddUint64(&s.IPRejected, 1)
+}
+
+// IncrQueueFull increment the write queue full number
+func (s *ConnStats) IncrQueueFull() {
+	atomic.AddUint64(&s.QueueFull, 1)
+}
+
+// IncrQueueDropped increment the frame dropped number
+func (s *ConnStats) IncrQueueDropped() {
+	atomic.AddUint64(&s.QueueDropped, 1)
+}
+
+// IncrSlowDisconnected increment the slow conn disconnected number
+func (s *ConnStats) IncrSlowDisconnected() {
+	atomic.AddUint64(&s.SlowConn, 1)
+}
+
+// Stats get the conn stats json
+func (s *ConnStats) Stats() []byte {
+	res := map[string]interface{}{}
+	res["conn"] = connLimiter.Len()
+	res["sub_conn"] = subConns.Len()
+	res["node_rejected"] = atomic.LoadUint64(&s.NodeRejected)
+	res["ip_rejected"] = atomic.LoadUint64(&s.IPRejected)
+	res["queue_full"] = atomic.LoadUint64(&s.QueueFull)
+	res["queue_dropped"] = atomic.LoadUint64(&s.QueueDropped)
+	res["slow_conn"] = atomic.LoadUint64(&s.SlowConn)
+
+	return jsonRes(res)
+}
+
+// ChannelStats is the channel statistics, all the counters are updated
+// by atomic operations, so it's safe for concurrent use without lock.
+type ChannelStats struct {
+	Created     uint64 // channel created number
+	Expired     uint64 // channel expired number
+	Refreshed   uint64 // channel refreshed number
+	Message     uint64 // message pushed number
+	OfflineMsg  uint64 // offline message sent number
+	AddedConn   uint64 // conn added number
+	RemovedConn uint64 // conn removed number
+	AuthFailed  uint64 // token auth failed number
+	Swept       uint64 // channel swept number
+	PurgedMsg   uint64 // expired message purged number
+}
+
+// IncrCreated increment the channel created number
+func (s *ChannelStats) IncrCreated() {
+	atomic.AddUint64(&s.Created, 1)
+}
+
+// IncrExpired increment the channel expired number
+func (s *ChannelStats) IncrExpired() {
+	atomic.AddUint64(&s.Expired, 1)
+}
+
+// IncrRefreshed increment the channel refreshed number
+func (s *ChannelStats) IncrRefreshed() {
+	atomic.AddUint64(&s.Refreshed, 1)
+}
+
+// IncrMessage increment the message pushed number
+func (s *ChannelStats) IncrMessage() {
+	atomic.AddUint64(&s.Message, 1)
+}
+
+// IncrOfflineMsg increment the offline message sent number
+func (s *ChannelStats) IncrOfflineMsg() {
+	atomic.AddUint64(&s.OfflineMsg, 1)
+}
+
+// IncrAddedConn increment the conn added number
+func (s *ChannelStats) IncrAddedConn() {
+	atomic.AddUint64(&s.AddedConn, 1)
+}
+
+// IncrRemovedConn increment the conn removed number
+func (s *ChannelStats) IncrRemovedConn() {
+	atomic.AddUint64(&s.RemovedConn, 1)
+}
+
+// IncrAuthFailed increment the token auth failed number
+func (s *ChannelStats) IncrAuthFailed() {
+	atomic.AddUint64(&s.AuthFailed, 1)
+}
+
+// IncrSwept increment the channel swept number
+func (s *ChannelStats) IncrSwept() {
+	atomic.AddUint64(&s.Swept, 1)
+}
+
+// AddPurgedMsg add the expired message purged number
+func (s *ChannelStats) AddPurgedMsg(n uint64) {
+	atomic.AddUint64(&s.PurgedMsg, n)
+}
+
+// Stats get the channel stats json
+func (s *ChannelStats) Stats() []byte {
+	res := map[string]interface{}{}
+	res["created"] = atomic.LoadUint64(&s.Created)
+	res["expired"] = atomic.LoadUint64(&s.Expired)
+	res["refreshed"] = atomic.LoadUint64(&s.Refreshed)
+	res["message"] = atomic.LoadUint64(&s.Message)
+	res["offline_message"] = atomic.LoadUint64(&s.OfflineMsg)
+	res["added_conn"] = atomic.LoadUint64(&s.AddedConn)
+	res["removed_conn"] = atomic.LoadUint64(&s.RemovedConn)
+	res["auth_failed"] = atomic.LoadUint64(&s.AuthFailed)
+	res["swept"] = atomic.LoadUint64(&s.Swept)
+	res["purged_message"] = atomic.LoadUint64(&s.PurgedMsg)
+
+	return jsonRes(res)
+}
+
 // start stats, called at process start
 func StartStats() {
 	startTime = time.Now().UnixNano()
@@ -97,11 +232,21 @@ func ServerStats() []byte {
 	return jsonRes(res)
 }
 
-// configuration info
+// configuration info, the auth key secrets hidden, only the key ids shown
 func ConfigInfo() []byte {
-	strJson, err := json.Marshal(Conf)
+	c := *Conf()
+	if len(c.AuthKeys) > 0 {
+		keys := make(map[string]string, len(c.AuthKeys))
+		for kid, _ := range c.AuthKeys {
+			keys[kid] = authKeyHidden
+		}
+
+		c.AuthKeys = keys
+	}
+
+	strJson, err := json.Marshal(&c)
 	if err != nil {
-		LogError(LogLevelErr, "json.Marshal(\"%v\") failed", Conf)
+		LogError(LogLevelErr, "json.Marshal(\"%v\") failed", &c)
 		return []byte{}
 	}
 
@@ -137,6 +282,12 @@ func StatHandle(w http.ResponseWriter, r *http.Request) {
 		res = GoStats()
 	case "confit":
 		res = ConfigInfo()
+	case "channel":
+		res = chStat.Stats()
+	case "conn":
+		res = connStat.Stats()
+	case "redis":
+		res = redisHealth.Stats()
 	}
 
 	if _, err := w.Write(res); err != nil {
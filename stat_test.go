@@ -22,6 +22,19 @@ func TestChannelStat(t *testing.T) {
 	}
 }
 
+func TestChannelStatCounters(t *testing.T) {
+	s := &ChannelStats{}
+	s.IncrSwept()
+	if s.Swept != 1 {
+		t.Errorf("swept must be 1, but %d", s.Swept)
+	}
+
+	s.AddPurgedMsg(3)
+	if s.PurgedMsg != 3 {
+		t.Errorf("purged messages must be 3, but %d", s.PurgedMsg)
+	}
+}
+
 func BenchmarkChannelStat(b *testing.B) {
 	s := &ChannelStats{}
 	for i := 0; i < b.N; i++ {
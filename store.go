@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// Channel backend registered twice
+	ChannelBackendExistErr = errors.New("Channel backend already registered")
+	// registered backends by channel type
+	channelBackends = map[int]*ChannelBackend{}
+)
+
+// MessageStore is the message storage of the channels, the key passed to
+// every method, so a store can be per key or shared by all the keys.
+type MessageStore interface {
+	// Save store the message.
+	// If the message id is AutoMsgID, allocate a increasing id for the key.
+	Save(m *Message, key string) error
+	// Range call f with the unexpired messages which id greate than mid and
+	// the acked message id in order, stop and return the error if f failed.
+	Range(mid int64, key string, f func(m *Message) error) error
+	// Ack advance the acked message id of the key.
+	Ack(mid int64, key string) error
+	// AckStat get the acked message id and unacked message number.
+	AckStat(key string) (*AckStat, error)
+	// Purge remove the expired messages, return the removed number.
+	Purge(key string) int
+	// Close release the store of the expired channel.
+	Close(key string) error
+}
+
+// TokenStore is the auth token storage of the channels, a token only used
+// once.
+type TokenStore interface {
+	// AddToken add a token for the key.
+	AddToken(token string, key string) error
+	// AuthToken auth and remove the token of the key.
+	AuthToken(token string, key string) error
+}
+
+// Publisher is a MessageStore deliver the saved messages to the conns of all
+// the nodes itself (e.g. redis pub/sub), the channel won't push the saved
+// messages to the local conns. Subscribe called before the offline messages
+// replayed, Unsubscribe called when the conn removed.
+type Publisher interface {
+	Subscribe(key string)
+	Unsubscribe(key string)
+}
+
+// ConnObserver is a MessageStore notified when a conn of the key added or
+// removed (e.g. record the online state). If ConnAdded failed, the conn is
+// removed.
+type ConnObserver interface {
+	ConnAdded(key string) error
+	ConnRemoved(key string) error
+}
+
+// ChannelBackend is a storage backend of the channels, registered by the
+// channel type.
+type ChannelBackend struct {
+	// Name used in logs and config errors
+	Name string
+	// Init called once when the channel list created, nil if needn't
+	Init func(l *ChannelList) error
+	// New the message and token stores of a key
+	New func(key string) (MessageStore, TokenStore, error)
+}
+
+// RegisterChannelBackend register the backend for the channel type, usually
+// called in init().
+func RegisterChannelBackend(typ int, b *ChannelBackend) error {
+	if _, ok := channelBackends[typ]; ok {
+		LogError(LogLevelErr, "channel type %d backend %s already registered", typ, b.Name)
+		return ChannelBackendExistErr
+	}
+
+	channelBackends[typ] = b
+	return nil
+}
+
+// channelBackendNames get the registered backends, e.g. "1: inner_channel"
+func channelBackendNames() string {
+	types := []int{}
+	for typ, _ := range channelBackends {
+		types = append(types, typ)
+	}
+
+	sort.Ints(types)
+	names := make([]string, 0, len(types))
+	for _, typ := range types {
+		names = append(names, fmt.Sprintf("%d: %s", typ, channelBackends[typ].Name))
+	}
+
+	return strings.Join(names, ", ")
+}
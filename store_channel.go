@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// StoreChannel is the Channel composed by the stores of a backend and the
+// shared conn fanout.
+type StoreChannel struct {
+	// Channel key
+	key string
+	// Serialize the local pushes, so the conns get the messages in id order
+	mutex *sync.Mutex
+	// Local conns
+	fanout *Fanout
+	// Message storage
+	store MessageStore
+	// Token storage
+	token TokenStore
+	// Channel expired unixnano
+	expire int64
+}
+
+// New a channel of the key by the stores
+func NewStoreChannel(key string, store MessageStore, token TokenStore) *StoreChannel {
+	return &StoreChannel{
+		key:    key,
+		mutex:  &sync.Mutex{},
+		fanout: NewFanout(),
+		store:  store,
+		token:  token,
+		expire: time.Now().UnixNano() + Conf().ChannelExpireSec*Second,
+	}
+}
+
+// PushMsg implements the Channel PushMsg method.
+func (c *StoreChannel) PushMsg(m *Message, key string) error {
+	if _, ok := c.store.(Publisher); ok {
+		// the store deliver the message to all the nodes
+		return c.store.Save(m, key)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.store.Save(m, key); err != nil {
+		return err
+	}
+
+	c.fanout.Push(m, key)
+	return nil
+}
+
+// Push send the message published by the store to the local conns.
+func (c *StoreChannel) Push(m *Message, key string) {
+	c.fanout.Push(m, key)
+}
+
+// SendMsg implements the Channel SendMsg method.
+func (c *StoreChannel) SendMsg(conn net.Conn, mid int64, key string) error {
+	p, ok := c.store.(Publisher)
+	if ok {
+		// subscribe before reading the offline messages, so no message
+		// lost
+		p.Subscribe(key)
+	}
+
+	if err := c.fanout.Replay(conn, mid, key, c.store); err != nil {
+		if ok {
+			p.Unsubscribe(key)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// AddConn implements the Channel AddConn method.
+func (c *StoreChannel) AddConn(conn net.Conn, mid int64, key string) error {
+	if o, ok := c.store.(ConnObserver); ok {
+		if err := o.ConnAdded(key); err != nil {
+			// drop the conn added by SendMsg, RemoveConn won't call if err
+			c.fanout.Remove(conn, key)
+			if p, ok := c.store.(Publisher); ok {
+				p.Unsubscribe(key)
+			}
+
+			return err
+		}
+	}
+
+	chStat.IncrAddedConn()
+	return nil
+}
+
+// RemoveConn implements the Channel RemoveConn method.
+func (c *StoreChannel) RemoveConn(conn net.Conn, mid int64, key string) error {
+	c.fanout.Remove(conn, key)
+	chStat.IncrRemovedConn()
+	if p, ok := c.store.(Publisher); ok {
+		p.Unsubscribe(key)
+	}
+
+	if o, ok := c.store.(ConnObserver); ok {
+		return o.ConnRemoved(key)
+	}
+
+	return nil
+}
+
+// AddToken implements the Channel AddToken method.
+func (c *StoreChannel) AddToken(token string, key string) error {
+	return c.token.AddToken(token, key)
+}
+
+// AuthToken implements the Channel AuthToken method.
+func (c *StoreChannel) AuthToken(token string, key string) error {
+	return c.token.AuthToken(token, key)
+}
+
+// Purge implements the Channel Purge method.
+func (c *StoreChannel) Purge(key string) int {
+	return c.store.Purge(key)
+}
+
+// Ack implements the Channel Ack method.
+func (c *StoreChannel) Ack(mid int64, key string) error {
+	return c.store.Ack(mid, key)
+}
+
+// AckStat implements the Channel AckStat method.
+func (c *StoreChannel) AckStat(key string) (*AckStat, error) {
+	s, err := c.store.AckStat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Delivered = c.fanout.Delivered()
+	return s, nil
+}
+
+// SetMaxMessage set the max message stored number if the store support
+func (c *StoreChannel) SetMaxMessage(n int) {
+	if s, ok := c.store.(interface {
+		SetMaxMessage(int)
+	}); ok {
+		s.SetMaxMessage(n)
+	}
+}
+
+// SetDeadline implements the Channel SetDeadline method.
+func (c *StoreChannel) SetDeadline(d int64) {
+	c.expire = d
+}
+
+// Timeout implements the Channel Timeout method.
+func (c *StoreChannel) Timeout() bool {
+	return time.Now().UnixNano() > c.expire
+}
+
+// Close implements the Channel Close method.
+func (c *StoreChannel) Close() error {
+	c.fanout.Close(c.key)
+	return c.store.Close(c.key)
+}
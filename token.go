@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// auth mode
+	AuthNone   = 0
+	AuthStored = 1
+	AuthSigned = 2
+	// signed token permissions
+	TokenPermSub = "sub"
+	TokenPermPub = "pub"
+	// the hmac secret min length
+	authKeyMinLen = 16
+	// the hmac secret shown in the config info
+	authKeyHidden = "******"
+)
+
+var (
+	// Token not "kid.payload.signature" or the payload error
+	TokenFmtErr = errors.New("Token format error")
+	// Token signed by a unknown key id
+	TokenKidErr = errors.New("Token key id unknown")
+	// Token signature mismatch
+	TokenSignErr = errors.New("Token signature error")
+	// Token expired
+	TokenExpiredErr = errors.New("Token expired")
+	// Token signed for other key
+	TokenKeyErr = errors.New("Token key mismatch")
+	// Token permission denied
+	TokenPermErr = errors.New("Token permission denied")
+)
+
+// SignedToken is the payload of the signed token, the token format:
+// base64url(kid).base64url(payload json).base64url(hmac-sha256)
+// the hmac signed "kid.payload" with the secret of the kid in
+// Conf().AuthKeys, the base64url without padding.
+type SignedToken struct {
+	// Subscriber key
+	Key string `json:"key"`
+	// Expired unix second
+	Expire int64 `json:"exp"`
+	// Permissions, only sub if empty
+	Perm []string `json:"perm,omitempty"`
+}
+
+// Allow check the token has the permission
+func (t *SignedToken) Allow(perm string) bool {
+	if len(t.Perm) == 0 {
+		return perm == TokenPermSub
+	}
+
+	for _, p := range t.Perm {
+		if p == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseToken verify the signature and expire time of the token, return the
+// payload
+func ParseToken(token string) (*SignedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, TokenFmtErr
+	}
+
+	kid, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, TokenFmtErr
+	}
+
+	// the keys can be rotated by reload, so read the current config
+	secret, ok := Conf().AuthKeys[string(kid)]
+	if !ok {
+		return nil, TokenKidErr
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, TokenFmtErr
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, TokenSignErr
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, TokenFmtErr
+	}
+
+	t := &SignedToken{}
+	if err = json.Unmarshal(payload, t); err != nil {
+		return nil, TokenFmtErr
+	}
+
+	if time.Now().Unix() > t.Expire {
+		return nil, TokenExpiredErr
+	}
+
+	return t, nil
+}
+
+// VerifyToken verify the signed token is valid for the key and permission
+func VerifyToken(token, key, perm string) (*SignedToken, error) {
+	t, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Key != key {
+		return nil, TokenKeyErr
+	}
+
+	if !t.Allow(perm) {
+		return nil, TokenPermErr
+	}
+
+	return t, nil
+}
+
+// subAuthChannel auth the subscribe token by the auth mode and fetch the
+// channel. The signed token verified before the channel created, the stored
+// token auth by the channel. If authed, skip the token auth.
+func subAuthChannel(key, token string, authed bool) (Channel, error) {
+	if Conf().Auth == AuthSigned && !authed {
+		if _, err := VerifyToken(token, key, TokenPermSub); err != nil {
+			chStat.IncrAuthFailed()
+			LogError(LogLevelErr, "device:%s verify token failed \"%s\" (%s)", key, token, err.Error())
+			return nil, err
+		}
+	}
+
+	c, err := subChannel(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if Conf().Auth == AuthStored && !authed {
+		if err = c.AuthToken(token, key); err != nil {
+			LogError(LogLevelErr, "device:%s auth token failed \"%s\" (%s)", key, token, err.Error())
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/Terry-Mao/gopush2/admin"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	SetConf(&Config{AuthKeys: map[string]string{"k1": "0123456789abcdef", "k2": "fedcba9876543210"}})
+	sub, err := admin.SignToken("k1", "0123456789abcdef", "Terry-Mao", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := admin.SignToken("k2", "fedcba9876543210", "Terry-Mao", time.Minute, admin.PermSub, admin.PermPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := admin.SignToken("k1", "0123456789abcdef", "Terry-Mao", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged, err := admin.SignToken("k1", "forged-secret-00", "Terry-Mao", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		key   string
+		perm  string
+		err   error
+	}{
+		{sub, "Terry-Mao", TokenPermSub, nil},
+		{sub, "Terry-Mao", TokenPermPub, TokenPermErr},
+		{sub, "other", TokenPermSub, TokenKeyErr},
+		{pub, "Terry-Mao", TokenPermPub, nil},
+		{expired, "Terry-Mao", TokenPermSub, TokenExpiredErr},
+		{forged, "Terry-Mao", TokenPermSub, TokenSignErr},
+		{"a.b", "Terry-Mao", TokenPermSub, TokenFmtErr},
+	}
+
+	for i, test := range tests {
+		if _, err = VerifyToken(test.token, test.key, test.perm); err != test.err {
+			t.Errorf("test %d must be %v, but %v", i, test.err, err)
+		}
+	}
+
+	// rotate, the k1 removed
+	SetConf(&Config{AuthKeys: map[string]string{"k2": "fedcba9876543210"}})
+	if _, err = VerifyToken(sub, "Terry-Mao", TokenPermSub); err != TokenKidErr {
+		t.Errorf("removed key id must be TokenKidErr, but %v", err)
+	}
+}
+
+func TestConfigInfoHideAuthKeys(t *testing.T) {
+	SetConf(&Config{AuthKeys: map[string]string{"k1": "0123456789abcdef"}})
+	info := string(ConfigInfo())
+	if strings.Contains(info, "0123456789abcdef") {
+		t.Errorf("config info must not contain the secret, but %s", info)
+	}
+
+	if !strings.Contains(info, `"k1"`) {
+		t.Errorf("config info must contain the key id, but %s", info)
+	}
+
+	// the current config not changed
+	if Conf().AuthKeys["k1"] != "0123456789abcdef" {
+		t.Error("auth keys must not be changed")
+	}
+}